@@ -1,9 +1,13 @@
 package constormsg
 
-import "encoding/gob"
+import (
+	"encoding/gob"
+	"time"
+)
 
 func RegisterTypes() {
 	gob.Register(Storing{})
+	gob.Register(Stored{})
 }
 
 type Storing struct {
@@ -12,4 +16,39 @@ type Storing struct {
 	Unchanged int
 	Remain    int
 	Done      bool
+
+	Bytes      int64         // Bytes of the finished items
+	Throughput float64       // Bytes per second since the storer started
+	ETA        time.Duration // Estimated time to finish the remaining items at the current throughput
+}
+
+// Stored is sent when an item is finished.
+type Stored struct {
+	Message  string // Message of the item
+	Bucket   string
+	Name     string
+	Bytes    int64
+	Duration time.Duration // Time taken to store the item, including retries
+	Status   Status
+	Error    string // Error message if Status is Failed
+}
+
+type Status int
+
+const (
+	Saved     Status = iota // The item was stored
+	Unchanged               // The immutable item already existed
+	Failed                  // The item failed to store
+)
+
+func (s Status) String() string {
+	switch s {
+	case Saved:
+		return "saved"
+	case Unchanged:
+		return "unchanged"
+	case Failed:
+		return "failed"
+	}
+	return "unknown"
 }
@@ -0,0 +1,90 @@
+package constor
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dave/services"
+)
+
+// Encoding compresses items before they are stored.
+type Encoding interface {
+	Name() string                         // Content-Encoding token, e.g. "gzip"
+	Ext() string                          // Suffix of precompressed variants, e.g. ".gz"
+	NewWriter(w io.Writer) io.WriteCloser // Compresses to w
+}
+
+var (
+	Gzip   Encoding = gzipEncoding{}
+	Brotli Encoding = brotliEncoding{}
+)
+
+type gzipEncoding struct{}
+
+func (gzipEncoding) Name() string { return "gzip" }
+func (gzipEncoding) Ext() string  { return ".gz" }
+
+func (gzipEncoding) NewWriter(w io.Writer) io.WriteCloser {
+	// NewWriterLevel only returns an error for invalid levels
+	gw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+	return gw
+}
+
+type brotliEncoding struct{}
+
+func (brotliEncoding) Name() string { return "br" }
+func (brotliEncoding) Ext() string  { return ".br" }
+
+func (brotliEncoding) NewWriter(w io.Writer) io.WriteCloser {
+	return brotli.NewWriterLevel(w, brotli.BestCompression)
+}
+
+// encode returns a reader of the compressed contents of r. The reader must be closed to release the
+// goroutine that compresses.
+func encode(r io.Reader, e Encoding) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := e.NewWriter(pw)
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return pr
+}
+
+// Decode returns a reader of the decompressed contents of r, which was stored with the Content-Encoding
+// contentEncoding.
+func Decode(r io.Reader, contentEncoding string) (io.Reader, error) {
+	switch contentEncoding {
+	case "", "identity":
+		return r, nil
+	case Gzip.Name():
+		return gzip.NewReader(r)
+	case Brotli.Name():
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", contentEncoding)
+}
+
+// Read is Fileserver.Read for items stored by a Storer: the contents are decompressed if the item was
+// stored with Options.Encoding.
+func Read(ctx context.Context, fileserver services.Fileserver, bucket, name string, writer io.Writer) (found bool, err error) {
+	reader, attrs, found, err := fileserver.Open(ctx, bucket, name, services.ReadOptions{})
+	if err != nil || !found {
+		return false, err
+	}
+	defer reader.Close()
+	decoded, err := Decode(reader, attrs.ContentEncoding)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(writer, decoded); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,76 @@
+package constor
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Known is a size-bounded, least recently used set of immutable items that are known to be stored. It
+// can be shared by all the storers in a process (see Options.Known) so that popular items are not
+// written again. It's safe for concurrent use.
+type Known struct {
+	max  int
+	m    sync.Mutex
+	keys map[knownKey]*list.Element
+	lru  *list.List // front is the most recently used
+}
+
+type knownKey struct {
+	bucket, name string
+}
+
+// NewKnown returns a Known that holds at most max keys.
+func NewKnown(max int) *Known {
+	return &Known{
+		max:  max,
+		keys: map[knownKey]*list.Element{},
+		lru:  list.New(),
+	}
+}
+
+// Has reports whether the item is known to be stored.
+func (k *Known) Has(bucket, name string) bool {
+	k.m.Lock()
+	defer k.m.Unlock()
+	e, ok := k.keys[knownKey{bucket, name}]
+	if !ok {
+		return false
+	}
+	k.lru.MoveToFront(e)
+	return true
+}
+
+// Add records that the item is stored, evicting the least recently used key if full.
+func (k *Known) Add(bucket, name string) {
+	k.m.Lock()
+	defer k.m.Unlock()
+	key := knownKey{bucket, name}
+	if e, ok := k.keys[key]; ok {
+		k.lru.MoveToFront(e)
+		return
+	}
+	k.keys[key] = k.lru.PushFront(key)
+	for k.lru.Len() > k.max {
+		oldest := k.lru.Back()
+		k.lru.Remove(oldest)
+		delete(k.keys, oldest.Value.(knownKey))
+	}
+}
+
+// Forget removes the item (e.g. after it has been deleted).
+func (k *Known) Forget(bucket, name string) {
+	k.m.Lock()
+	defer k.m.Unlock()
+	key := knownKey{bucket, name}
+	if e, ok := k.keys[key]; ok {
+		k.lru.Remove(e)
+		delete(k.keys, key)
+	}
+}
+
+// Len returns the number of known items.
+func (k *Known) Len() int {
+	k.m.Lock()
+	defer k.m.Unlock()
+	return k.lru.Len()
+}
@@ -4,8 +4,12 @@ package constor
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dave/services"
 	"github.com/dave/services/constor/constormsg"
@@ -29,6 +33,7 @@ import (
 	<path>/index.html       - index file deployed by compile.jsgo.io
 	<short-path>.js         - index file deployed by compile.jsgo.io
 	<short-path>/index.html - index file deployed by compile.jsgo.io
+	manifest/<path>.<hash>.json - deploy manifest written by compile.jsgo.io
 
 	src.jsgo.io (Src)
 	-----------------
@@ -39,41 +44,214 @@ import (
     <repo-url>              - git repo archive (repo url is encoded with url.PathEscape)
 */
 type Storer struct {
+	// accessed atomically, so must be first in the struct for 64-bit alignment on 32-bit platforms
+	bytesTotal int64 // bytes of the counted items, excluding items that failed or were skipped
+	bytesDone  int64 // bytes of the counted items that have finished
+
+	start      time.Time
+	ctx        context.Context
 	fileserver services.Fileserver
+	options    Options
 	queue      chan Item
+	closed     chan struct{}
 	wait       sync.WaitGroup
 	unchanged  int32
 	done       int32
 	total      int32
-	err        error
 	send       func(services.Message)
+
+	m         sync.Mutex // protects errs, cancelled, stopped and inflight
+	errs      Errors     // items that failed to store
+	cancelled error      // context error if items were skipped because the context was cancelled
+	stopped   bool       // true if remaining items are skipped because of CancelOnError
+	inflight  int64      // bytes of the items that have been added and not yet finished
+	budget    *sync.Cond // signalled when inflight decreases or the context is cancelled
+}
+
+type Options struct {
+	Workers   int // Number of concurrent uploads
+	QueueSize int // Maximum number of queued items (default 1000)
+
+	// MaxBytes is the maximum total size of the items that have been added but not yet stored. Add
+	// blocks until there's enough budget for the item. An item larger than MaxBytes is only added when
+	// no other items are in flight. Zero means no limit.
+	MaxBytes int64
+
+	// Encoding compresses each item before it's stored under its own name with the Content-Encoding
+	// set. Use with fileservers that decompress for clients that don't accept the encoding (e.g. GCS).
+	Encoding Encoding
+
+	// Variants are precompressed variants stored alongside each item as <name><ext> with the
+	// Content-Encoding set (e.g. <path>.<hash>.js.gz). Fileservers that negotiate Accept-Encoding
+	// (e.g. localfileserver) serve them in place of the item.
+	Variants []Encoding
+
+	// Retries is the number of times an item is retried after a transient error. The delay before the
+	// first retry is Backoff (default 100ms), and it's doubled for each subsequent retry.
+	Retries int
+	Backoff time.Duration
+
+	// Transient reports whether an error is transient and should be retried. If nil, IsTransient is
+	// used.
+	Transient func(error) bool
+
+	// CancelOnError skips the remaining items after the first permanent error.
+	CancelOnError bool
+
+	// Private stores items with private Cache-Control headers, so shared caches (e.g. CDNs) never
+	// cache them. Use for buckets that are only served with signed URLs.
+	Private bool
+
+	// Known is consulted before immutable items are queued. Items that are known to be stored are
+	// counted as unchanged without being written. Share one Known between storers to avoid repeated
+	// writes of popular items.
+	Known *Known
+}
+
+// IsTransient reports whether err has a Temporary or Timeout method (e.g. net.Error) that returns
+// true.
+func IsTransient(err error) bool {
+	if e, ok := err.(interface{ Temporary() bool }); ok && e.Temporary() {
+		return true
+	}
+	if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
+		return true
+	}
+	return false
+}
+
+// Error is an item that failed to store.
+type Error struct {
+	Bucket, Name string
+	Err          error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s/%s: %v", e.Bucket, e.Name, e.Err)
+}
+
+// Errors is returned by Wait when any items failed to store.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("failed to store %d item(s): %s", len(e), strings.Join(messages, "; "))
 }
 
 func New(ctx context.Context, fileserver services.Fileserver, send func(services.Message), workers int) *Storer {
+	return NewWithOptions(ctx, fileserver, send, Options{Workers: workers})
+}
+
+func NewWithOptions(ctx context.Context, fileserver services.Fileserver, send func(services.Message), options Options) *Storer {
+	queueSize := options.QueueSize
+	if queueSize == 0 {
+		queueSize = 1000
+	}
 	s := &Storer{
+		start:      time.Now(),
+		ctx:        ctx,
 		fileserver: fileserver,
-		queue:      make(chan Item, 1000),
+		options:    options,
+		queue:      make(chan Item, queueSize),
+		closed:     make(chan struct{}),
 		wait:       sync.WaitGroup{},
 		send:       send,
 	}
-	for i := 0; i < workers; i++ {
+	s.budget = sync.NewCond(&s.m)
+	for i := 0; i < options.Workers; i++ {
 		go s.Worker(ctx)
 	}
+	go func() {
+		// wake any producers waiting for budget when the context is cancelled
+		select {
+		case <-ctx.Done():
+			s.m.Lock()
+			defer s.m.Unlock()
+			s.budget.Broadcast()
+		case <-s.closed:
+		}
+	}()
 	return s
 }
 
 func (s *Storer) Close() {
 	close(s.queue)
+	close(s.closed)
 }
 
+// Wait waits for all items to finish. If any items failed to store, the error is Errors. If items
+// were skipped because the context was cancelled, the error is the context error.
 func (s *Storer) Wait() error {
 	s.wait.Wait()
-	if s.err != nil {
-		return s.err
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.errs) > 0 {
+		return s.errs
+	}
+	if s.cancelled != nil {
+		return s.cancelled
 	}
 	return nil
 }
 
+func (s *Storer) fail(item Item, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.errs = append(s.errs, &Error{Bucket: item.Bucket, Name: item.Name, Err: err})
+	if s.options.CancelOnError {
+		s.stopped = true
+	}
+}
+
+// skip reports whether the item should be skipped because the context has been cancelled or a previous
+// item failed with CancelOnError set.
+func (s *Storer) skip(ctx context.Context) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if ctx.Err() != nil {
+		s.cancelled = ctx.Err()
+		return true
+	}
+	return s.stopped
+}
+
+// reserve waits until there's enough budget for size bytes. It returns false if the context is
+// cancelled first.
+func (s *Storer) reserve(size int64) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for s.options.MaxBytes > 0 && s.inflight > 0 && s.inflight+size > s.options.MaxBytes {
+		if s.ctx.Err() != nil {
+			return false
+		}
+		s.budget.Wait()
+	}
+	s.inflight += size
+	return true
+}
+
+func (s *Storer) release(size int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.inflight -= size
+	s.budget.Broadcast()
+}
+
+// drop finishes an item that was never queued because the context was cancelled.
+func (s *Storer) drop(item Item) {
+	s.m.Lock()
+	s.cancelled = s.ctx.Err()
+	s.m.Unlock()
+	s.abandon(item)
+	if item.Wait != nil {
+		item.Wait.Done()
+	}
+	s.wait.Done()
+}
+
 func (s *Storer) Worker(ctx context.Context) {
 	for item := range s.queue {
 		func() {
@@ -81,34 +259,161 @@ func (s *Storer) Worker(ctx context.Context) {
 			if item.Wait != nil {
 				defer item.Wait.Done()
 			}
-			overwrite := true
-			cacheControl := "no-cache"
-			if item.Immutable {
-				overwrite = false
-				cacheControl = "public,max-age=31536000,immutable"
+			defer s.release(item.size())
+			if s.skip(ctx) {
+				// don't store any more items after the context has been cancelled or an item has failed
+				// with CancelOnError set
+				s.abandon(item)
+				return
 			}
-			saved, err := s.fileserver.Write(ctx, item.Bucket, item.Name, bytes.NewReader(item.Contents), overwrite, item.Mime, cacheControl)
+			overwrite := !item.Immutable
+			start := time.Now()
+			saved, err := s.storeWithRetry(ctx, item, overwrite, s.cacheControl(item))
 			if err != nil {
-				s.err = err
+				s.fail(item, err)
+				s.abandon(item)
+				s.sendStored(item, constormsg.Failed, time.Since(start), err)
 				return
 			}
-			if item.Count {
-				if saved {
-					atomic.AddInt32(&s.done, 1)
-				} else {
-					atomic.AddInt32(&s.unchanged, 1)
-				}
-			}
-			if item.Done != nil {
-				item.Done()
-			}
-			if item.Send {
-				s.sendMessage()
+			if item.Immutable && s.options.Known != nil {
+				s.options.Known.Add(item.Bucket, item.Name)
 			}
+			s.finish(item, saved, time.Since(start))
 		}()
 	}
 }
 
+// cacheControl is the Cache-Control header the item is stored with.
+func (s *Storer) cacheControl(item Item) string {
+	switch {
+	case item.Immutable && s.options.Private:
+		return "private,max-age=31536000,immutable"
+	case item.Immutable:
+		return "public,max-age=31536000,immutable"
+	case s.options.Private:
+		return "private,no-cache"
+	default:
+		return "no-cache"
+	}
+}
+
+// abandon removes the bytes of a counted item that failed or was skipped from the total, so they're
+// not included in the ETA.
+func (s *Storer) abandon(item Item) {
+	if item.Count {
+		atomic.AddInt64(&s.bytesTotal, -item.size())
+	}
+}
+
+// finish updates the counters and calls the callbacks for an item that has been stored.
+func (s *Storer) finish(item Item, saved bool, duration time.Duration) {
+	if item.Count {
+		if saved {
+			atomic.AddInt32(&s.done, 1)
+		} else {
+			atomic.AddInt32(&s.unchanged, 1)
+		}
+		atomic.AddInt64(&s.bytesDone, item.size())
+	}
+	if item.Result != nil {
+		item.Result(saved)
+	}
+	if item.Done != nil {
+		item.Done()
+	}
+	status := constormsg.Saved
+	if !saved {
+		status = constormsg.Unchanged
+	}
+	s.sendStored(item, status, duration, nil)
+	if item.Send {
+		s.sendMessage()
+	}
+}
+
+// sendStored sends a constormsg.Stored message for the item if it has Send set.
+func (s *Storer) sendStored(item Item, status constormsg.Status, duration time.Duration, err error) {
+	if s.send == nil || !item.Send {
+		return
+	}
+	m := constormsg.Stored{
+		Message:  item.Message,
+		Bucket:   item.Bucket,
+		Name:     item.Name,
+		Bytes:    item.size(),
+		Duration: duration,
+		Status:   status,
+	}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	s.send(m)
+}
+
+// storeWithRetry calls store, retrying transient errors with exponential backoff.
+func (s *Storer) storeWithRetry(ctx context.Context, item Item, overwrite bool, cacheControl string) (saved bool, err error) {
+	transient := s.options.Transient
+	if transient == nil {
+		transient = IsTransient
+	}
+	delay := s.options.Backoff
+	if delay == 0 {
+		delay = 100 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		saved, err := s.store(ctx, item, overwrite, cacheControl)
+		if err == nil {
+			return saved, nil
+		}
+		if attempt >= s.options.Retries || !transient(err) {
+			return false, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false, err
+		}
+		delay *= 2
+	}
+}
+
+// store writes the item, encoded if Options.Encoding is set, followed by any precompressed variants.
+// The variants are written even if the immutable item already exists, because a previous attempt may
+// have failed after writing it. saved is true if any write stored something.
+func (s *Storer) store(ctx context.Context, item Item, overwrite bool, cacheControl string) (saved bool, err error) {
+	saved, err = s.write(ctx, item, item.Name, s.options.Encoding, overwrite, cacheControl)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range s.options.Variants {
+		variantSaved, err := s.write(ctx, item, item.Name+e.Ext(), e, overwrite, cacheControl)
+		if err != nil {
+			return false, err
+		}
+		saved = saved || variantSaved
+	}
+	return saved, nil
+}
+
+// write opens the item contents and writes them to name, compressed with e if it's not nil.
+func (s *Storer) write(ctx context.Context, item Item, name string, e Encoding, overwrite bool, cacheControl string) (saved bool, err error) {
+	r, err := item.open()
+	if err != nil {
+		return false, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	var contentEncoding string
+	if e != nil {
+		encoded := encode(r, e)
+		defer encoded.Close()
+		r = encoded
+		contentEncoding = e.Name()
+	}
+	return s.fileserver.Write(ctx, item.Bucket, name, r, overwrite, item.Mime, cacheControl, contentEncoding)
+}
+
 func (s *Storer) sendMessage() {
 	if s.send == nil {
 		return
@@ -116,21 +421,59 @@ func (s *Storer) sendMessage() {
 	total := int(atomic.LoadInt32(&s.total))
 	done := int(atomic.LoadInt32(&s.done))
 	unchanged := int(atomic.LoadInt32(&s.unchanged))
-	s.send(constormsg.Storing{Finished: done, Unchanged: unchanged, Remain: total - done - unchanged})
+	bytesTotal := atomic.LoadInt64(&s.bytesTotal)
+	bytesDone := atomic.LoadInt64(&s.bytesDone)
+	var throughput float64
+	var eta time.Duration
+	if elapsed := time.Since(s.start).Seconds(); elapsed > 0 {
+		throughput = float64(bytesDone) / elapsed
+	}
+	if throughput > 0 {
+		eta = time.Duration(float64(bytesTotal-bytesDone) / throughput * float64(time.Second))
+	}
+	s.send(constormsg.Storing{
+		Finished:   done,
+		Unchanged:  unchanged,
+		Remain:     total - done - unchanged,
+		Bytes:      bytesDone,
+		Throughput: throughput,
+		ETA:        eta,
+	})
 }
 
 func (s *Storer) Add(item Item) {
-	s.wait.Add(1)
 
 	if item.Count {
 		atomic.AddInt32(&s.total, 1)
+		atomic.AddInt64(&s.bytesTotal, item.size())
+	}
+
+	if item.Immutable && s.options.Known != nil && s.options.Known.Has(item.Bucket, item.Name) {
+		// the item is already stored, so it's unchanged and there's no need to queue it
+		s.finish(item, false, 0)
+		if item.Wait != nil {
+			item.Wait.Done()
+		}
+		return
 	}
+
+	s.wait.Add(1)
+
 	if item.Send {
 		s.sendMessage()
 	}
 
-	s.queue <- item
+	if !s.reserve(item.size()) {
+		s.drop(item)
+		return
+	}
 
+	select {
+	case s.queue <- item:
+	case <-s.ctx.Done():
+		s.release(item.size())
+		s.drop(item)
+	}
 }
 
 const (
@@ -143,14 +486,36 @@ const (
 )
 
 type Item struct {
-	Message   string
-	Bucket    string
-	Name      string
-	Contents  []byte
+	Message  string
+	Bucket   string
+	Name     string
+	Contents []byte
+
+	// Reader opens the contents of a streaming item, and is used instead of Contents. It may be called
+	// more than once (e.g. for retries and variants). If the reader is an io.Closer it's closed after
+	// use. Size is the size of the contents, used for Options.MaxBytes.
+	Reader func() (io.Reader, error)
+	Size   int64
+
 	Mime      string
 	Immutable bool
 	Count     bool
 	Wait      *sync.WaitGroup
 	Send      bool
 	Done      func()
+	Result    func(saved bool) // Called after the item is stored. saved is false if it already existed.
+}
+
+func (item Item) size() int64 {
+	if item.Reader != nil {
+		return item.Size
+	}
+	return int64(len(item.Contents))
+}
+
+func (item Item) open() (io.Reader, error) {
+	if item.Reader != nil {
+		return item.Reader()
+	}
+	return bytes.NewReader(item.Contents), nil
 }
@@ -0,0 +1,342 @@
+package constor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dave/services"
+	"github.com/dave/services/constor/constormsg"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	fs := &flaky{failures: map[string]int{"a": 2, "b": 5}}
+	s := NewWithOptions(ctx, fs, nil, Options{Workers: 2, Retries: 3, Backoff: time.Millisecond})
+	defer s.Close()
+	s.Add(Item{Bucket: "bucket", Name: "a"})
+	s.Add(Item{Bucket: "bucket", Name: "b"})
+	err := s.Wait()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expected Errors, got %#v", err)
+	}
+	if len(errs) != 1 || errs[0].Name != "b" {
+		t.Fatalf("expected b to fail, got %v", errs)
+	}
+	if fs.stored["a"] != 1 || fs.stored["b"] != 0 {
+		t.Fatalf("unexpected stored: %v", fs.stored)
+	}
+}
+
+func TestRetryVariants(t *testing.T) {
+	ctx := context.Background()
+	fs := &flaky{failures: map[string]int{"a.gz": 1, "a.br": 2}}
+	s := NewWithOptions(ctx, fs, nil, Options{Workers: 1, Retries: 3, Backoff: time.Millisecond, Variants: []Encoding{Gzip, Brotli}})
+	defer s.Close()
+	var saved bool
+	s.Add(Item{Bucket: "bucket", Name: "a", Reader: stream("aaaaaa"), Immutable: true, Result: func(b bool) { saved = b }})
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !saved {
+		t.Fatal("expected item to be reported as saved")
+	}
+	for _, name := range []string{"a", "a.gz", "a.br"} {
+		if fs.stored[name] != 1 {
+			t.Fatalf("expected %s to be stored, got %v", name, fs.stored)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	for _, test := range []struct {
+		immutable, private bool
+		expected           string
+	}{
+		{false, false, "no-cache"},
+		{true, false, "public,max-age=31536000,immutable"},
+		{false, true, "private,no-cache"},
+		{true, true, "private,max-age=31536000,immutable"},
+	} {
+		s := &Storer{options: Options{Private: test.private}}
+		if found := s.cacheControl(Item{Immutable: test.immutable}); found != test.expected {
+			t.Fatalf("expected %q, got %q", test.expected, found)
+		}
+	}
+}
+
+func TestStoreVariants(t *testing.T) {
+	ctx := context.Background()
+	fs := &flaky{failures: map[string]int{"a.gz": 1}}
+	options := Options{Workers: 1, Variants: []Encoding{Gzip, Brotli}}
+	item := Item{Bucket: "bucket", Name: "a", Reader: stream("aaaaaa"), Immutable: true}
+
+	// the first attempt stores a, then fails to store a.gz
+	s := NewWithOptions(ctx, fs, nil, options)
+	s.Add(item)
+	if err := s.Wait(); err == nil {
+		t.Fatal("expected error")
+	}
+	s.Close()
+
+	// the second attempt finds a already stored, but still stores the variants
+	var saved bool
+	item.Result = func(b bool) { saved = b }
+	s = NewWithOptions(ctx, fs, nil, options)
+	defer s.Close()
+	s.Add(item)
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !saved {
+		t.Fatal("expected item to be reported as saved")
+	}
+	if fs.stored["a"] != 1 || fs.stored["a.gz"] != 1 || fs.stored["a.br"] != 1 {
+		t.Fatalf("unexpected stored: %v", fs.stored)
+	}
+}
+
+func TestCancelOnError(t *testing.T) {
+	ctx := context.Background()
+	fs := &flaky{permanent: map[string]bool{"a": true}}
+	s := NewWithOptions(ctx, fs, nil, Options{Workers: 1, CancelOnError: true})
+	defer s.Close()
+	s.Add(Item{Bucket: "bucket", Name: "a"})
+	s.Add(Item{Bucket: "bucket", Name: "b"})
+	if err := s.Wait(); err == nil {
+		t.Fatal("expected error")
+	}
+	if fs.stored["b"] != 0 {
+		t.Fatal("expected b to be skipped")
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	fs := &blocking{release: release}
+	s := NewWithOptions(ctx, fs, nil, Options{Workers: 2, MaxBytes: 10})
+	defer s.Close()
+	s.Add(Item{Bucket: "bucket", Name: "a", Reader: stream("aaaaaa"), Size: 6})
+	added := make(chan struct{})
+	go func() {
+		s.Add(Item{Bucket: "bucket", Name: "b", Reader: stream("bbbbbb"), Size: 6})
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("expected Add to block until a is stored")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-added
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	fs := &flaky{permanent: map[string]bool{"b": true}}
+	var messages []services.Message
+	var m sync.Mutex
+	send := func(message services.Message) {
+		m.Lock()
+		defer m.Unlock()
+		messages = append(messages, message)
+	}
+	s := NewWithOptions(ctx, fs, send, Options{Workers: 1})
+	defer s.Close()
+	s.Add(Item{Bucket: "bucket", Name: "a", Contents: []byte("aaaa"), Count: true, Send: true})
+	s.Add(Item{Bucket: "bucket", Name: "b", Contents: []byte("bbbbbbbbbbbb"), Count: true, Send: true})
+	if err := s.Wait(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	stored := map[string]constormsg.Stored{}
+	for _, message := range messages {
+		if m, ok := message.(constormsg.Stored); ok {
+			stored[m.Name] = m
+		}
+	}
+	if a := stored["a"]; a.Status != constormsg.Saved || a.Bytes != 4 || a.Error != "" {
+		t.Fatalf("unexpected Stored for a: %#v", a)
+	}
+	if b := stored["b"]; b.Status != constormsg.Failed || b.Bytes != 12 || b.Error != "permanent" {
+		t.Fatalf("unexpected Stored for b: %#v", b)
+	}
+
+	// the failed item isn't remaining, so there's nothing left to store
+	if total, done := atomic.LoadInt64(&s.bytesTotal), atomic.LoadInt64(&s.bytesDone); total != 4 || done != 4 {
+		t.Fatalf("expected 4 of 4 bytes, got %d of %d", done, total)
+	}
+	s.sendMessage()
+	m.Lock()
+	storing := messages[len(messages)-1].(constormsg.Storing)
+	m.Unlock()
+	if storing.Bytes != 4 || storing.ETA != 0 || storing.Throughput <= 0 {
+		t.Fatalf("unexpected Storing: %#v", storing)
+	}
+}
+
+func TestETA(t *testing.T) {
+	var messages []services.Message
+	s := &Storer{
+		start:      time.Now().Add(-2 * time.Second),
+		bytesTotal: 300,
+		bytesDone:  100,
+		send:       func(m services.Message) { messages = append(messages, m) },
+	}
+	s.sendMessage()
+	storing := messages[0].(constormsg.Storing)
+	// 100 bytes in 2s is 50 bytes/s, so the remaining 200 bytes take 4s
+	if storing.Throughput < 49 || storing.Throughput > 50 {
+		t.Fatalf("expected throughput of about 50, got %v", storing.Throughput)
+	}
+	if storing.ETA < 3900*time.Millisecond || storing.ETA > 4100*time.Millisecond {
+		t.Fatalf("expected ETA of about 4s, got %v", storing.ETA)
+	}
+}
+
+func TestKnownEviction(t *testing.T) {
+	k := NewKnown(2)
+	k.Add("bucket", "a")
+	k.Add("bucket", "b")
+	// a is used, so b is the least recently used
+	if !k.Has("bucket", "a") {
+		t.Fatal("expected a to be known")
+	}
+	k.Add("bucket", "c")
+	if k.Len() != 2 || !k.Has("bucket", "a") || k.Has("bucket", "b") || !k.Has("bucket", "c") {
+		t.Fatalf("expected b to be evicted, got %d known", k.Len())
+	}
+	if k.Has("other", "a") {
+		t.Fatal("expected keys to include the bucket")
+	}
+	k.Forget("bucket", "a")
+	if k.Len() != 1 || k.Has("bucket", "a") {
+		t.Fatal("expected a to be forgotten")
+	}
+}
+
+func TestKnownSkip(t *testing.T) {
+	ctx := context.Background()
+	fs := &flaky{}
+	known := NewKnown(10)
+	var messages []services.Message
+	var m sync.Mutex
+	send := func(message services.Message) {
+		m.Lock()
+		defer m.Unlock()
+		messages = append(messages, message)
+	}
+
+	// the first storer stores a and records it
+	s := NewWithOptions(ctx, fs, nil, Options{Workers: 1, Known: known})
+	s.Add(Item{Bucket: "bucket", Name: "a", Contents: []byte("a"), Immutable: true})
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if !known.Has("bucket", "a") {
+		t.Fatal("expected a to be known")
+	}
+
+	// the second storer skips a, but counts it as unchanged
+	s = NewWithOptions(ctx, fs, send, Options{Workers: 1, Known: known})
+	defer s.Close()
+	var saved, done bool
+	result := func(b bool) { saved = b }
+	s.Add(Item{Bucket: "bucket", Name: "a", Contents: []byte("a"), Immutable: true, Count: true, Send: true, Result: result, Done: func() { done = true }})
+	s.Add(Item{Bucket: "bucket", Name: "b", Contents: []byte("b"), Count: true, Send: true})
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if fs.stored["a"] != 1 || fs.stored["b"] != 1 {
+		t.Fatalf("expected a to be stored once, got %v", fs.stored)
+	}
+	if saved || !done {
+		t.Fatalf("expected a to be reported as unchanged and done, got saved %v done %v", saved, done)
+	}
+	if known.Has("bucket", "b") {
+		t.Fatal("expected mutable b not to be known")
+	}
+	s.sendMessage()
+	m.Lock()
+	defer m.Unlock()
+	storing := messages[len(messages)-1].(constormsg.Storing)
+	if storing.Finished != 1 || storing.Unchanged != 1 || storing.Remain != 0 {
+		t.Fatalf("unexpected Storing: %#v", storing)
+	}
+	var unchanged bool
+	for _, message := range messages {
+		if m, ok := message.(constormsg.Stored); ok && m.Name == "a" {
+			unchanged = m.Status == constormsg.Unchanged
+		}
+	}
+	if !unchanged {
+		t.Fatal("expected a Stored message with Unchanged status for a")
+	}
+}
+
+func stream(contents string) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		return strings.NewReader(contents), nil
+	}
+}
+
+// blocking is a services.Fileserver that blocks writes until release is closed.
+type blocking struct {
+	services.Fileserver
+	release chan struct{}
+}
+
+func (b *blocking) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	<-b.release
+	return true, nil
+}
+
+type temporary struct{}
+
+func (temporary) Error() string   { return "temporary" }
+func (temporary) Temporary() bool { return true }
+
+// flaky is a services.Fileserver that fails the first failures[name] writes with a temporary error,
+// and always fails writes of permanent[name]. Writes without overwrite of stored names aren't saved.
+type flaky struct {
+	services.Fileserver
+	m         sync.Mutex
+	failures  map[string]int
+	permanent map[string]bool
+	stored    map[string]int
+}
+
+func (f *flaky) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		return false, err
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.permanent[name] {
+		return false, errors.New("permanent")
+	}
+	if f.failures[name] > 0 {
+		f.failures[name]--
+		return false, temporary{}
+	}
+	if f.stored == nil {
+		f.stored = map[string]int{}
+	}
+	if !overwrite && f.stored[name] > 0 {
+		return false, nil
+	}
+	f.stored[name]++
+	return true, nil
+}
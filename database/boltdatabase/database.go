@@ -0,0 +1,599 @@
+// package boltdatabase is a services.Database stored in a single bolt file, for running on a single
+// server without Datastore. Entities are stored as JSON (like localdatabase) in a bolt bucket per
+// kind, ordered by key, so they can be scanned by kind.
+package boltdatabase
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dave/services"
+
+	"cloud.google.com/go/datastore"
+	"github.com/mitchellh/go-homedir"
+	bolt "go.etcd.io/bbolt"
+)
+
+// New opens (or creates) the database file. The file is locked, so only one process can open it.
+func New(fpath string) (*Database, error) {
+	expanded, err := homedir.Expand(fpath)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(expanded, 0666, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Database{db: db}, nil
+}
+
+type Database struct {
+	db *bolt.DB
+
+	// tx is the transaction of a Database passed to a RunInTransaction func, and finished is set to 1
+	// when the func returns.
+	tx       *bolt.Tx
+	finished *int32
+}
+
+var errFinished = errors.New("transaction used after RunInTransaction returned")
+
+// Close closes the database file.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+// view runs f in a read-only bolt transaction, or in the current transaction if there is one.
+func (d *Database) view(f func(tx *bolt.Tx) error) error {
+	if d.tx != nil {
+		if atomic.LoadInt32(d.finished) == 1 {
+			return errFinished
+		}
+		return f(d.tx)
+	}
+	return d.db.View(f)
+}
+
+// update runs f in a read-write bolt transaction, or in the current transaction if there is one.
+func (d *Database) update(f func(tx *bolt.Tx) error) error {
+	if d.tx != nil {
+		if atomic.LoadInt32(d.finished) == 1 {
+			return errFinished
+		}
+		return f(d.tx)
+	}
+	return d.db.Update(f)
+}
+
+// RunInTransaction runs f in one bolt read-write transaction, so f is never retried, but blocks all
+// other writes until it returns. A failed PutMulti inside f only rolls back if f returns an error. Bolt
+// transactions aren't safe for concurrent use, so tx mustn't be shared between goroutines, and it
+// returns errors if it's used after f returns. If ctx is cancelled before f returns, the transaction is
+// rolled back.
+func (d *Database) RunInTransaction(ctx context.Context, f func(tx services.Database) error) error {
+	if d.tx != nil {
+		return errors.New("nested transactions are not supported")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		finished := new(int32)
+		defer atomic.StoreInt32(finished, 1)
+		if err := f(&Database{db: d.db, tx: tx, finished: finished}); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+func (d *Database) Get(ctx context.Context, key *datastore.Key, dst interface{}) (err error) {
+	if key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	return d.view(func(tx *bolt.Tx) error {
+		return get(tx, key, dst)
+	})
+}
+
+func get(tx *bolt.Tx, key *datastore.Key, dst interface{}) error {
+	b := tx.Bucket(bucketName(key))
+	if b == nil {
+		return datastore.ErrNoSuchEntity
+	}
+	v := b.Get(encodeKey(key))
+	if v == nil {
+		return datastore.ErrNoSuchEntity
+	}
+	return json.Unmarshal(v, dst)
+}
+
+// Put stores the entity. An incomplete key is given the next ID of its kind.
+func (d *Database) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	err := d.update(func(tx *bolt.Tx) error {
+		k, err := put(tx, key, src)
+		key = k
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func put(tx *bolt.Tx, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	v, err := json.Marshal(src)
+	if err != nil {
+		return nil, err
+	}
+	b, err := tx.CreateBucketIfNotExists(bucketName(key))
+	if err != nil {
+		return nil, err
+	}
+	if key.Incomplete() {
+		id, err := b.NextSequence()
+		if err != nil {
+			return nil, err
+		}
+		complete := *key
+		complete.ID = int64(id)
+		key = &complete
+	}
+	if err := b.Put(encodeKey(key), v); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (d *Database) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) (err error) {
+	v := reflect.ValueOf(dst)
+	multiArgType, _ := checkMultiArg(v)
+
+	// Sanity checks
+	if multiArgType == multiArgTypeInvalid {
+		return errors.New("datastore: dst has invalid type")
+	}
+	if len(keys) != v.Len() {
+		return errors.New("datastore: keys and dst slices have different length")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	multiErr, any := make(datastore.MultiError, len(keys)), false
+	for i, k := range keys {
+		if k.Incomplete() {
+			multiErr[i] = datastore.ErrInvalidKey
+			any = true
+		}
+	}
+	if any {
+		return multiErr
+	}
+
+	// all entities are read in one transaction, so they're consistent
+	if err := d.view(func(tx *bolt.Tx) error {
+		for i, k := range keys {
+			if err := get(tx, k, multiElem(v, i, multiArgType)); err != nil {
+				multiErr[i] = err
+				any = true
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if any {
+		return multiErr
+	}
+	return nil
+}
+
+// PutMulti stores the entities in one transaction, so either all or none are stored.
+func (d *Database) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) (_ []*datastore.Key, err error) {
+	v := reflect.ValueOf(src)
+	multiArgType, _ := checkMultiArg(v)
+	if multiArgType == multiArgTypeInvalid {
+		return nil, errors.New("datastore: src has invalid type")
+	}
+	if len(keys) != v.Len() {
+		return nil, errors.New("datastore: key and src slices have different length")
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	completed := make([]*datastore.Key, len(keys))
+	multiErr, hasErr := make(datastore.MultiError, len(keys)), false
+	if err := d.update(func(tx *bolt.Tx) error {
+		for i, k := range keys {
+			key, err := put(tx, k, multiElem(v, i, multiArgType))
+			if err != nil {
+				multiErr[i] = err
+				hasErr = true
+				continue
+			}
+			completed[i] = key
+		}
+		if hasErr {
+			// roll back
+			return multiErr
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return completed, nil
+}
+
+func (d *Database) Delete(ctx context.Context, key *datastore.Key) error {
+	if key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	return d.update(func(tx *bolt.Tx) error {
+		return del(tx, key)
+	})
+}
+
+func del(tx *bolt.Tx, key *datastore.Key) error {
+	b := tx.Bucket(bucketName(key))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(encodeKey(key))
+}
+
+// DeleteMulti deletes the entities in one transaction, so either all or none are deleted.
+func (d *Database) DeleteMulti(ctx context.Context, keys []*datastore.Key) (err error) {
+	multiErr, any := make(datastore.MultiError, len(keys)), false
+	for i, k := range keys {
+		if k.Incomplete() {
+			multiErr[i] = datastore.ErrInvalidKey
+			any = true
+		}
+	}
+	if any {
+		return multiErr
+	}
+	return d.update(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			if err := del(tx, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Query seeks to the prefix for prefix queries. Other queries scan all entities of the kind, because
+// parents are encoded opaquely.
+func (d *Database) Query(ctx context.Context, q services.Query, dst interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, errors.New("datastore: dst must be a pointer to a slice")
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil, errors.New("datastore: dst must be a pointer to a slice of structs or struct pointers")
+	}
+	var namespace string
+	if q.Ancestor != nil {
+		namespace = q.Ancestor.Namespace
+	}
+	type entity struct {
+		key   *datastore.Key
+		value []byte
+	}
+	var entities []entity
+	err := d.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName(&datastore.Key{Kind: q.Kind, Namespace: namespace}))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		if q.Prefix != "" {
+			parent := encodeParent(q.Ancestor)
+			prefix := append(append(parent, 'n'), q.Prefix...)
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if q.Limit > 0 && len(entities) == q.Limit {
+					break
+				}
+				key, err := decodeKey(q.Kind, namespace, q.Ancestor, k[len(parent):])
+				if err != nil {
+					return err
+				}
+				entities = append(entities, entity{key, v})
+			}
+			return nil
+		}
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var parent *datastore.Key
+			if k[0] == 'p' {
+				end := bytes.IndexByte(k, 0)
+				if end == -1 {
+					return errors.New("invalid key")
+				}
+				p, err := datastore.DecodeKey(string(k[1:end]))
+				if err != nil {
+					return err
+				}
+				parent, k = p, k[end+1:]
+			}
+			key, err := decodeKey(q.Kind, namespace, parent, k)
+			if err != nil {
+				return err
+			}
+			if q.Ancestor != nil && !hasAncestor(key, q.Ancestor) {
+				continue
+			}
+			entities = append(entities, entity{key, v})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entities, func(i, j int) bool { return compareKeys(entities[i].key, entities[j].key) < 0 })
+	if q.Limit > 0 && len(entities) > q.Limit {
+		entities = entities[:q.Limit]
+	}
+	var keys []*datastore.Key
+	for _, e := range entities {
+		elem := reflect.New(elemType)
+		if err := json.Unmarshal(e.value, elem.Interface()); err != nil {
+			return nil, err
+		}
+		if isPtr {
+			slice = reflect.Append(slice, elem)
+		} else {
+			slice = reflect.Append(slice, elem.Elem())
+		}
+		keys = append(keys, e.key)
+	}
+	v.Elem().Set(slice)
+	return keys, nil
+}
+
+// hasAncestor reports whether ancestor is key or one of its ancestors.
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	for k := key; k != nil; k = k.Parent {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareKeys compares keys in datastore order: element by element from the root, by kind and then
+// ID or name, with IDs before names and ancestors before descendants.
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := path(a), path(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		ea, eb := pa[i], pb[i]
+		if c := strings.Compare(ea.Kind, eb.Kind); c != 0 {
+			return c
+		}
+		switch {
+		case ea.Name == "" && eb.Name != "":
+			return -1
+		case ea.Name != "" && eb.Name == "":
+			return 1
+		case ea.ID < eb.ID:
+			return -1
+		case ea.ID > eb.ID:
+			return 1
+		}
+		if c := strings.Compare(ea.Name, eb.Name); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// path returns the elements of the key from the root.
+func path(key *datastore.Key) []*datastore.Key {
+	var p []*datastore.Key
+	for k := key; k != nil; k = k.Parent {
+		p = append([]*datastore.Key{k}, p...)
+	}
+	return p
+}
+
+// Scan loads the entities of kind (in the namespace and with the parent of start, or the root if start
+// is nil) with keys from start (inclusive) to end (exclusive) into dst, which must be a pointer to a
+// slice of structs or struct pointers. Nil start or end are unbounded. Keys are ordered with IDs before
+// names. If limit is more than zero, at most limit entities are loaded. The keys of the loaded
+// entities are returned.
+func (d *Database) Scan(ctx context.Context, kind string, start, end *datastore.Key, limit int, dst interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, errors.New("datastore: dst must be a pointer to a slice")
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil, errors.New("datastore: dst must be a pointer to a slice of structs or struct pointers")
+	}
+	scope := datastore.NameKey(kind, "", nil)
+	if start != nil {
+		scope = start
+	}
+	var keys []*datastore.Key
+	err := d.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName(&datastore.Key{Kind: kind, Namespace: scope.Namespace}))
+		if b == nil {
+			return nil
+		}
+		prefix := encodeParent(scope.Parent)
+		var max []byte
+		if end != nil {
+			max = encodeKey(end)
+		}
+		c := b.Cursor()
+		k, v := c.Seek(prefix)
+		if start != nil {
+			k, v = c.Seek(encodeKey(start))
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if max != nil && bytes.Compare(k, max) >= 0 {
+				break
+			}
+			if limit > 0 && len(keys) == limit {
+				break
+			}
+			if scope.Parent == nil && k[0] == 'p' {
+				// entities with parents sort after root entities
+				break
+			}
+			key, err := decodeKey(kind, scope.Namespace, scope.Parent, k[len(prefix):])
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(elemType)
+			if err := json.Unmarshal(v, elem.Interface()); err != nil {
+				return err
+			}
+			if isPtr {
+				slice = reflect.Append(slice, elem)
+			} else {
+				slice = reflect.Append(slice, elem.Elem())
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	v.Elem().Set(slice)
+	return keys, nil
+}
+
+// bucketName returns the bolt bucket of the key's kind.
+func bucketName(key *datastore.Key) []byte {
+	if key.Namespace == "" {
+		return []byte(key.Kind)
+	}
+	return []byte(key.Namespace + "\x00" + key.Kind)
+}
+
+// encodeKey encodes a key so that bytewise order is key order: the encoded parent, then "i" and the
+// big-endian ID, or "n" and the name.
+func encodeKey(key *datastore.Key) []byte {
+	b := encodeParent(key.Parent)
+	if key.Name != "" {
+		return append(append(b, 'n'), key.Name...)
+	}
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(key.ID))
+	return append(append(b, 'i'), id...)
+}
+
+// encodeParent encodes the parent key as "p", the opaque encoded key and a zero byte, or returns an
+// empty prefix for keys without a parent.
+func encodeParent(parent *datastore.Key) []byte {
+	if parent == nil {
+		return []byte{}
+	}
+	return []byte("p" + parent.Encode() + "\x00")
+}
+
+func decodeKey(kind, namespace string, parent *datastore.Key, b []byte) (*datastore.Key, error) {
+	if len(b) == 0 {
+		return nil, errors.New("invalid key")
+	}
+	key := &datastore.Key{Kind: kind, Namespace: namespace, Parent: parent}
+	switch b[0] {
+	case 'n':
+		key.Name = string(b[1:])
+	case 'i':
+		if len(b) != 9 {
+			return nil, errors.New("invalid key")
+		}
+		key.ID = int64(binary.BigEndian.Uint64(b[1:]))
+	default:
+		return nil, errors.New("invalid key")
+	}
+	return key, nil
+}
+
+// multiElem returns the element of a multi arg slice to load into or save from.
+func multiElem(v reflect.Value, i int, multiArgType multiArgType) interface{} {
+	elem := v.Index(i)
+	// Two cases where we need to take the address:
+	// 1) multiArgTypePropertyLoadSaver => &elem implements PLS
+	// 2) multiArgTypeStruct => saveEntity needs *struct
+	if multiArgType == multiArgTypePropertyLoadSaver || multiArgType == multiArgTypeStruct {
+		elem = elem.Addr()
+	}
+	if multiArgType == multiArgTypeStructPtr && elem.IsNil() {
+		elem.Set(reflect.New(elem.Type().Elem()))
+	}
+	return elem.Interface()
+}
+
+// checkMultiArg checks that v has type []S, []*S, []I, or []P, for some struct
+// type S, for some interface type I, or some non-interface non-pointer type P
+// such that P or *P implements PropertyLoadSaver.
+//
+// It returns what category the slice's elements are, and the reflect.Type
+// that represents S, I or P.
+//
+// As a special case, PropertyList is an invalid type for v.
+func checkMultiArg(v reflect.Value) (m multiArgType, elemType reflect.Type) {
+	if v.Kind() != reflect.Slice {
+		return multiArgTypeInvalid, nil
+	}
+	if v.Type() == typeOfPropertyList {
+		return multiArgTypeInvalid, nil
+	}
+	elemType = v.Type().Elem()
+	if reflect.PtrTo(elemType).Implements(typeOfPropertyLoadSaver) {
+		return multiArgTypePropertyLoadSaver, elemType
+	}
+	switch elemType.Kind() {
+	case reflect.Struct:
+		return multiArgTypeStruct, elemType
+	case reflect.Interface:
+		return multiArgTypeInterface, elemType
+	case reflect.Ptr:
+		elemType = elemType.Elem()
+		if elemType.Kind() == reflect.Struct {
+			return multiArgTypeStructPtr, elemType
+		}
+	}
+	return multiArgTypeInvalid, nil
+}
+
+type multiArgType int
+
+const (
+	multiArgTypeInvalid multiArgType = iota
+	multiArgTypePropertyLoadSaver
+	multiArgTypeStruct
+	multiArgTypeStructPtr
+	multiArgTypeInterface
+)
+
+var (
+	typeOfPropertyLoadSaver = reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()
+	typeOfPropertyList      = reflect.TypeOf(datastore.PropertyList(nil))
+)
@@ -0,0 +1,177 @@
+package boltdatabase
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dave/services"
+	"github.com/dave/services/database/databasetest"
+	bolt "go.etcd.io/bbolt"
+)
+
+type entity struct {
+	Value string
+	Fail  bool `json:"-"`
+}
+
+func (e entity) MarshalJSON() ([]byte, error) {
+	if e.Fail {
+		return nil, errors.New("fail")
+	}
+	return []byte(`{"Value":"` + e.Value + `"}`), nil
+}
+
+func open(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "boltdatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPutMulti(t *testing.T) {
+	ctx := context.Background()
+	d, close := open(t)
+	defer close()
+
+	keys := []*datastore.Key{datastore.NameKey("Kind", "a", nil), datastore.IncompleteKey("Kind", nil)}
+	completed, err := d.PutMulti(ctx, keys, []entity{{Value: "a"}, {Value: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed[1].Incomplete() {
+		t.Fatal("expected incomplete key to be completed")
+	}
+	dst := make([]entity, 2)
+	if err := d.GetMulti(ctx, completed, dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst[0].Value != "a" || dst[1].Value != "b" {
+		t.Fatalf("unexpected entities: %+v", dst)
+	}
+
+	// the transaction is rolled back if any entity fails
+	keys = []*datastore.Key{datastore.NameKey("Kind", "c", nil), datastore.NameKey("Kind", "d", nil)}
+	if _, err := d.PutMulti(ctx, keys, []entity{{Value: "c"}, {Fail: true}}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.Get(ctx, keys[0], &entity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected ErrNoSuchEntity, got %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	d, close := open(t)
+	defer close()
+
+	parent := datastore.NameKey("Parent", "p", nil)
+	for _, k := range []*datastore.Key{
+		datastore.NameKey("Kind", "b", nil),
+		datastore.NameKey("Kind", "a", nil),
+		datastore.IDKey("Kind", 2, nil),
+		datastore.NameKey("Kind", "c", nil),
+		datastore.NameKey("Kind", "child", parent),
+		datastore.NameKey("Other", "x", nil),
+	} {
+		if _, err := d.Put(ctx, k, entity{Value: k.String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var all []entity
+	keys, err := d.Scan(ctx, "Kind", nil, nil, 0, &all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 || keys[0].ID != 2 || keys[1].Name != "a" || keys[3].Name != "c" || len(all) != 4 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	var some []*entity
+	keys, err = d.Scan(ctx, "Kind", datastore.NameKey("Kind", "a", nil), datastore.NameKey("Kind", "c", nil), 0, &some)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Name != "a" || keys[1].Name != "b" || some[1].Value != keys[1].String() {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	var children []entity
+	keys, err = d.Scan(ctx, "Kind", datastore.NameKey("Kind", "", parent), nil, 1, &children)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Name != "child" || !keys[0].Parent.Equal(parent) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	databasetest.Run(t, func(t *testing.T) (services.Database, func()) {
+		return open(t)
+	})
+}
+
+func TestTransactionScope(t *testing.T) {
+	ctx := context.Background()
+	d, close := open(t)
+	defer close()
+
+	// tx can't be used after f returns
+	var escaped services.Database
+	if err := d.RunInTransaction(ctx, func(tx services.Database) error {
+		escaped = tx
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := escaped.Put(ctx, datastore.NameKey("Kind", "a", nil), entity{Value: "a"}); err != errFinished {
+		t.Fatalf("expected errFinished, got %v", err)
+	}
+
+	// a transaction is rolled back if ctx is cancelled before f returns
+	cctx, cancel := context.WithCancel(ctx)
+	if err := d.RunInTransaction(cctx, func(tx services.Database) error {
+		if _, err := tx.Put(ctx, datastore.NameKey("Kind", "b", nil), entity{Value: "b"}); err != nil {
+			return err
+		}
+		cancel()
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := d.Get(ctx, datastore.NameKey("Kind", "b", nil), &entity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected ErrNoSuchEntity, got %v", err)
+	}
+}
+
+func TestScanCorruptKey(t *testing.T) {
+	ctx := context.Background()
+	d, close := open(t)
+	defer close()
+	if _, err := d.Put(ctx, datastore.NameKey("Kind", "a", nil), entity{Value: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Kind")).Put([]byte("x"), []byte("{}"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var dst []entity
+	if _, err := d.Scan(ctx, "Kind", nil, nil, 0, &dst); err == nil {
+		t.Fatal("expected the corrupt key to be reported")
+	}
+}
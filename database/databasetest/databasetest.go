@@ -0,0 +1,208 @@
+// package databasetest is a conformance test suite for services.Database implementations.
+package databasetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dave/services"
+)
+
+// Run runs the conformance tests. New is called at the start of each test, and must return an empty
+// database, and a function to release its resources when the test finishes (or nil).
+func Run(t *testing.T, New func(t *testing.T) (db services.Database, close func())) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db services.Database)
+	}{
+		{"Delete", testDelete},
+		{"Query", testQuery},
+		{"Transaction", testTransaction},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db, close := New(t)
+			if close != nil {
+				defer close()
+			}
+			test.test(t, db)
+		})
+	}
+}
+
+type entity struct {
+	Value string
+}
+
+func put(t *testing.T, db services.Database, keys ...*datastore.Key) {
+	t.Helper()
+	for _, k := range keys {
+		if _, err := db.Put(context.Background(), k, &entity{Value: k.String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testDelete(t *testing.T, db services.Database) {
+	ctx := context.Background()
+	a, b := datastore.NameKey("Kind", "a", nil), datastore.NameKey("Kind", "b", nil)
+	put(t, db, a, b)
+	if err := db.Delete(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, a, &entity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected ErrNoSuchEntity, got %v", err)
+	}
+	if err := db.Get(ctx, b, &entity{}); err != nil {
+		t.Fatal(err)
+	}
+	// deleting a missing entity isn't an error
+	if err := db.DeleteMulti(ctx, []*datastore.Key{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, b, &entity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected ErrNoSuchEntity, got %v", err)
+	}
+}
+
+func testQuery(t *testing.T, db services.Database) {
+	ctx := context.Background()
+	parent := datastore.NameKey("Parent", "p", nil)
+	child := datastore.NameKey("Kind", "ab-child", parent)
+	put(t, db,
+		datastore.NameKey("Kind", "b", nil),
+		datastore.NameKey("Kind", "ab", nil),
+		datastore.NameKey("Kind", "a", nil),
+		datastore.IDKey("Kind", 2, nil),
+		datastore.NameKey("Kind", "ac", nil),
+		datastore.NameKey("Other", "ab", nil),
+		parent,
+		child,
+		datastore.NameKey("Kind", "grandchild", child),
+		// descendants in the key ranges of prefix queries, which only match direct children
+		datastore.NameKey("Kind", "ab-grandchild", child),
+		datastore.NameKey("Kind", "ab-nested", datastore.NameKey("Kind", "ab", nil)),
+	)
+
+	names := func(q services.Query) []string {
+		t.Helper()
+		var dst []entity
+		keys, err := db.Query(ctx, q, &dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != len(dst) {
+			t.Fatalf("got %d keys and %d entities", len(keys), len(dst))
+		}
+		var names []string
+		for i, k := range keys {
+			if dst[i].Value != k.String() {
+				t.Fatalf("entity %q loaded for key %v", dst[i].Value, k)
+			}
+			if k.Name == "" {
+				names = append(names, "#")
+			} else {
+				names = append(names, k.Name)
+			}
+		}
+		return names
+	}
+
+	tests := []struct {
+		name     string
+		query    services.Query
+		expected []string
+	}{
+		{"kind", services.Query{Kind: "Kind"}, []string{"#", "a", "ab", "ab-nested", "ac", "b", "ab-child", "ab-grandchild", "grandchild"}},
+		{"limit", services.Query{Kind: "Kind", Limit: 2}, []string{"#", "a"}},
+		{"prefix", services.Query{Kind: "Kind", Prefix: "a"}, []string{"a", "ab", "ac"}},
+		{"prefix limit", services.Query{Kind: "Kind", Prefix: "a", Limit: 2}, []string{"a", "ab"}},
+		{"prefix limit descendants", services.Query{Kind: "Kind", Prefix: "a", Limit: 3}, []string{"a", "ab", "ac"}},
+		{"ancestor", services.Query{Kind: "Kind", Ancestor: parent}, []string{"ab-child", "ab-grandchild", "grandchild"}},
+		{"ancestor prefix", services.Query{Kind: "Kind", Ancestor: parent, Prefix: "ab"}, []string{"ab-child"}},
+		{"ancestor prefix child", services.Query{Kind: "Kind", Ancestor: child, Prefix: "ab"}, []string{"ab-grandchild"}},
+		{"ancestor itself", services.Query{Kind: "Parent", Ancestor: parent}, []string{"p"}},
+		{"missing", services.Query{Kind: "Missing"}, nil},
+	}
+	for _, test := range tests {
+		found := names(test.query)
+		if len(found) != len(test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, found)
+		}
+		for i := range found {
+			if found[i] != test.expected[i] {
+				t.Fatalf("%s: expected %v, got %v", test.name, test.expected, found)
+			}
+		}
+	}
+
+	var ptrs []*entity
+	if _, err := db.Query(ctx, services.Query{Kind: "Other"}, &ptrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 1 || ptrs[0].Value != datastore.NameKey("Other", "ab", nil).String() {
+		t.Fatalf("unexpected entities: %v", ptrs)
+	}
+}
+
+func testTransaction(t *testing.T, db services.Database) {
+	ctx := context.Background()
+	parent := datastore.NameKey("Parent", "p", nil)
+	a, b := datastore.NameKey("Kind", "a", parent), datastore.NameKey("Kind", "b", parent)
+	put(t, db, a)
+
+	// the writes of a failed transaction are discarded
+	fail := errors.New("fail")
+	if err := db.RunInTransaction(ctx, func(tx services.Database) error {
+		if err := tx.Delete(ctx, a); err != nil {
+			return err
+		}
+		if _, err := tx.Put(ctx, b, &entity{Value: "b"}); err != nil {
+			return err
+		}
+		return fail
+	}); err != fail {
+		t.Fatalf("expected %v, got %v", fail, err)
+	}
+	if err := db.Get(ctx, a, &entity{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(ctx, b, &entity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected ErrNoSuchEntity, got %v", err)
+	}
+
+	// a transaction that reads a and writes b
+	if err := db.RunInTransaction(ctx, func(tx services.Database) error {
+		var e entity
+		if err := tx.Get(ctx, a, &e); err != nil {
+			return err
+		}
+		var dst []entity
+		keys, err := tx.Query(ctx, services.Query{Kind: "Kind", Ancestor: parent}, &dst)
+		if err != nil {
+			return err
+		}
+		if len(keys) != 1 || !keys[0].Equal(a) {
+			t.Errorf("unexpected keys: %v", keys)
+		}
+		if _, err := tx.Put(ctx, b, &entity{Value: e.Value + "b"}); err != nil {
+			return err
+		}
+		return tx.Delete(ctx, a)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var e entity
+	if err := db.Get(ctx, b, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Value != a.String()+"b" {
+		t.Fatalf("unexpected value %q", e.Value)
+	}
+	if err := db.Get(ctx, a, &entity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected ErrNoSuchEntity, got %v", err)
+	}
+}
@@ -1,7 +1,12 @@
 package gcsdatabase
 
 import (
+	"context"
+	"errors"
+	"reflect"
+
 	"cloud.google.com/go/datastore"
+	"github.com/dave/services"
 )
 
 func New(client *datastore.Client) *Database {
@@ -13,3 +18,145 @@ func New(client *datastore.Client) *Database {
 type Database struct {
 	*datastore.Client
 }
+
+func (d *Database) Query(ctx context.Context, q services.Query, dst interface{}) ([]*datastore.Key, error) {
+	if q.Prefix == "" {
+		return d.GetAll(ctx, query(q), dst)
+	}
+	keys, err := d.GetAll(ctx, query(q).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	keys = children(q, keys)
+	if err := load(keys, dst, func(keys []*datastore.Key, dst interface{}) error {
+		return d.GetMulti(ctx, keys, dst)
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// query converts q to a datastore query. The prefix is a key range from the prefix to the prefix
+// followed by the highest code point. The range also includes descendants of the matching entities,
+// so prefix queries aren't limited, and the keys must be filtered with children.
+func query(q services.Query) *datastore.Query {
+	dq := datastore.NewQuery(q.Kind)
+	if q.Ancestor != nil {
+		dq = dq.Ancestor(q.Ancestor)
+	}
+	if q.Prefix != "" {
+		dq = dq.
+			Filter("__key__ >=", datastore.NameKey(q.Kind, q.Prefix, q.Ancestor)).
+			Filter("__key__ <", datastore.NameKey(q.Kind, q.Prefix+"\U0010FFFF", q.Ancestor))
+	}
+	if q.Limit > 0 && q.Prefix == "" {
+		dq = dq.Limit(q.Limit)
+	}
+	return dq
+}
+
+// children returns the keys of a prefix query that are children of q.Ancestor (root keys if it's nil),
+// limited to q.Limit.
+func children(q services.Query, keys []*datastore.Key) []*datastore.Key {
+	var out []*datastore.Key
+	for _, key := range keys {
+		if q.Limit > 0 && len(out) == q.Limit {
+			break
+		}
+		if key.Parent == nil || q.Ancestor == nil {
+			if key.Parent == nil && q.Ancestor == nil {
+				out = append(out, key)
+			}
+			continue
+		}
+		if key.Parent.Equal(q.Ancestor) {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// load loads the entities of keys with getMulti and appends them to dst, which is a pointer to a slice
+// of structs or struct pointers, as GetAll does.
+func load(keys []*datastore.Key, dst interface{}, getMulti func(keys []*datastore.Key, dst interface{}) error) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return errors.New("datastore: dst must be a pointer to a slice")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	entities := reflect.MakeSlice(v.Elem().Type(), len(keys), len(keys))
+	if err := getMulti(keys, entities.Interface()); err != nil {
+		return err
+	}
+	v.Elem().Set(reflect.AppendSlice(v.Elem(), entities))
+	return nil
+}
+
+func (d *Database) RunInTransaction(ctx context.Context, f func(tx services.Database) error) error {
+	_, err := d.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(&transaction{client: d.Client, tx: tx})
+	})
+	return err
+}
+
+// transaction is the services.Database of a datastore transaction. Incomplete keys passed to Put and
+// PutMulti are returned unchanged, because they're only completed when the transaction commits.
+type transaction struct {
+	client *datastore.Client
+	tx     *datastore.Transaction
+}
+
+func (t *transaction) Get(ctx context.Context, key *datastore.Key, dst interface{}) (err error) {
+	return t.tx.Get(key, dst)
+}
+
+func (t *transaction) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if _, err := t.tx.Put(key, src); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (t *transaction) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) (err error) {
+	return t.tx.GetMulti(keys, dst)
+}
+
+func (t *transaction) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) (_ []*datastore.Key, err error) {
+	if _, err := t.tx.PutMulti(keys, src); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (t *transaction) Delete(ctx context.Context, key *datastore.Key) error {
+	return t.tx.Delete(key)
+}
+
+func (t *transaction) DeleteMulti(ctx context.Context, keys []*datastore.Key) (err error) {
+	return t.tx.DeleteMulti(keys)
+}
+
+// Query only supports ancestor queries, because datastore transactions only support ancestor queries.
+func (t *transaction) Query(ctx context.Context, q services.Query, dst interface{}) ([]*datastore.Key, error) {
+	if q.Ancestor == nil {
+		return nil, errors.New("queries in transactions must have an ancestor")
+	}
+	if q.Prefix == "" {
+		return t.client.GetAll(ctx, query(q).Transaction(t.tx), dst)
+	}
+	keys, err := t.client.GetAll(ctx, query(q).KeysOnly().Transaction(t.tx), nil)
+	if err != nil {
+		return nil, err
+	}
+	keys = children(q, keys)
+	if err := load(keys, dst, t.tx.GetMulti); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (t *transaction) RunInTransaction(ctx context.Context, f func(tx services.Database) error) error {
+	return errors.New("nested transactions are not supported")
+}
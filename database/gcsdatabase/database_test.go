@@ -0,0 +1,106 @@
+package gcsdatabase
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dave/services"
+	"github.com/dave/services/database/databasetest"
+)
+
+// TestConformance runs against the datastore emulator in DATASTORE_EMULATOR_HOST, which is reset
+// before each test. Start the emulator with --consistency=1.0, or queries may miss recent writes.
+func TestConformance(t *testing.T) {
+	host := os.Getenv("DATASTORE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	databasetest.Run(t, func(t *testing.T) (services.Database, func()) {
+		resp, err := http.Post("http://"+host+"/reset", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return New(client), nil
+	})
+}
+
+func TestChildren(t *testing.T) {
+	parent := datastore.NameKey("Parent", "p", nil)
+	ab := datastore.NameKey("Kind", "ab", nil)
+	child := datastore.NameKey("Kind", "ab-child", parent)
+	// the key range of a prefix query includes the descendants of the matching entities
+	keys := []*datastore.Key{
+		ab,
+		datastore.NameKey("Kind", "ab-nested", ab),
+		datastore.NameKey("Kind", "ac", nil),
+		child,
+		datastore.NameKey("Kind", "ab-grandchild", child),
+	}
+	for _, test := range []struct {
+		name     string
+		query    services.Query
+		keys     []*datastore.Key
+		expected []*datastore.Key
+	}{
+		{"root", services.Query{Kind: "Kind", Prefix: "a"}, keys[:3], []*datastore.Key{keys[0], keys[2]}},
+		{"root limit", services.Query{Kind: "Kind", Prefix: "a", Limit: 1}, keys[:3], []*datastore.Key{keys[0]}},
+		{"ancestor", services.Query{Kind: "Kind", Prefix: "ab", Ancestor: parent}, keys[3:], []*datastore.Key{child}},
+		{"none", services.Query{Kind: "Kind", Prefix: "ab", Ancestor: parent}, nil, nil},
+	} {
+		found := children(test.query, test.keys)
+		if len(found) != len(test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, found)
+		}
+		for i := range found {
+			if !found[i].Equal(test.expected[i]) {
+				t.Fatalf("%s: expected %v, got %v", test.name, test.expected, found)
+			}
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	type entity struct{ Value string }
+	keys := []*datastore.Key{datastore.NameKey("Kind", "a", nil), datastore.NameKey("Kind", "b", nil)}
+	getMulti := func(keys []*datastore.Key, dst interface{}) error {
+		switch dst := dst.(type) {
+		case []entity:
+			for i, k := range keys {
+				dst[i].Value = k.Name
+			}
+		case []*entity:
+			for i, k := range keys {
+				dst[i] = &entity{Value: k.Name}
+			}
+		}
+		return nil
+	}
+	// entities are appended, as GetAll does
+	values := []entity{{Value: "existing"}}
+	if err := load(keys, &values, getMulti); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[1].Value != "a" || values[2].Value != "b" {
+		t.Fatalf("unexpected entities: %v", values)
+	}
+	var ptrs []*entity
+	if err := load(keys, &ptrs, getMulti); err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 2 || ptrs[0].Value != "a" || ptrs[1].Value != "b" {
+		t.Fatalf("unexpected entities: %v", ptrs)
+	}
+	if err := load(keys, values, getMulti); err == nil {
+		t.Fatal("expected error for a non-pointer dst")
+	}
+}
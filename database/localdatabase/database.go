@@ -1,18 +1,25 @@
 package localdatabase
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/dave/services"
 	"github.com/mitchellh/go-homedir"
 )
 
@@ -21,31 +28,160 @@ func New(dir string) *Database {
 	if err != nil {
 		panic(err)
 	}
-	return &Database{
+	d := &Database{
 		dir: expanded,
 	}
+	if err := d.migrate(); err != nil {
+		panic(err)
+	}
+	return d
 }
 
+// Database stores each entity as a JSON file in <dir>/entities. The path is the kind and the ID
+// (prefixed with "i") or name (prefixed with "n") of each element of the key from the root, so IDs and
+// names can't be confused.
 type Database struct {
 	dir string
+	m   sync.Mutex
 }
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+func (d *Database) root() string {
+	return filepath.Join(d.dir, "entities")
+}
+
 func (d *Database) fpath(key *datastore.Key) string {
-	kind := url.PathEscape(key.Kind)
-	var name string
-	if key.ID > 0 {
-		name = fmt.Sprint(key.ID)
-	} else {
-		name = url.PathEscape(key.Name)
+	var elements []string
+	for k := key; k != nil; k = k.Parent {
+		var name string
+		if k.ID > 0 {
+			name = "i" + strconv.FormatInt(k.ID, 10)
+		} else {
+			name = "n" + url.PathEscape(k.Name)
+		}
+		elements = append([]string{escapeKind(k.Kind), name}, elements...)
+	}
+	elements[len(elements)-1] += ".json"
+	return filepath.Join(append([]string{d.root()}, elements...)...)
+}
+
+// escapeKind converts a kind to a directory name. The dot segments "." and ".." are the only kinds
+// that aren't changed by url.PathEscape but aren't valid directory names.
+func escapeKind(kind string) string {
+	escaped := url.PathEscape(kind)
+	if escaped == "." || escaped == ".." {
+		return strings.Replace(escaped, ".", "%2E", -1)
+	}
+	return escaped
+}
+
+// decodePath returns the key of a file path relative to the root.
+func decodePath(rel string) (*datastore.Key, error) {
+	elements := strings.Split(filepath.ToSlash(strings.TrimSuffix(rel, ".json")), "/")
+	if len(elements)%2 != 0 {
+		return nil, fmt.Errorf("invalid path %q", rel)
+	}
+	var key *datastore.Key
+	for i := 0; i < len(elements); i += 2 {
+		kind, err := url.PathUnescape(elements[i])
+		if err != nil {
+			return nil, err
+		}
+		name := elements[i+1]
+		switch {
+		case strings.HasPrefix(name, "i"):
+			id, err := strconv.ParseInt(name[1:], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q", rel)
+			}
+			key = datastore.IDKey(kind, id, key)
+		case strings.HasPrefix(name, "n"):
+			unescaped, err := url.PathUnescape(name[1:])
+			if err != nil {
+				return nil, err
+			}
+			key = datastore.NameKey(kind, unescaped, key)
+		default:
+			return nil, fmt.Errorf("invalid path %q", rel)
+		}
+	}
+	return key, nil
+}
+
+// migrate moves the entities stored by earlier versions in <dir>/datastore/<kind>/<id or name>.json
+// to the current layout. Earlier versions didn't store parents, so they become root entities, and
+// names made only of digits become IDs, as earlier versions read them.
+func (d *Database) migrate() error {
+	legacy := filepath.Join(d.dir, "datastore")
+	kinds, err := ioutil.ReadDir(legacy)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, kind := range kinds {
+		if !kind.IsDir() {
+			continue
+		}
+		dir := filepath.Join(legacy, kind.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			key, err := legacyKey(kind.Name(), strings.TrimSuffix(file.Name(), ".json"))
+			if err != nil {
+				return err
+			}
+			fpath := d.fpath(key)
+			if _, err := os.Stat(fpath); err == nil {
+				// already written in the current layout, so the legacy file is stale
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(fpath), 0777); err != nil {
+				return err
+			}
+			if err := os.Rename(filepath.Join(dir, file.Name()), fpath); err != nil {
+				return err
+			}
+		}
+		// fails if anything unexpected is left, which is then kept
+		os.Remove(dir)
 	}
-	return filepath.Join(d.dir, "datastore", kind, name+".json")
+	os.Remove(legacy)
+	return nil
+}
+
+// legacyKey returns the key of a file name in the layout of earlier versions.
+func legacyKey(kind, name string) (*datastore.Key, error) {
+	kind, err := url.PathUnescape(kind)
+	if err != nil {
+		return nil, err
+	}
+	if id, err := strconv.ParseInt(name, 10, 64); err == nil && id > 0 {
+		return datastore.IDKey(kind, id, nil), nil
+	}
+	name, err = url.PathUnescape(name)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NameKey(kind, name, nil), nil
 }
 
 func (d *Database) Get(ctx context.Context, key *datastore.Key, dst interface{}) (err error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.get(key, dst)
+}
+
+func (d *Database) get(key *datastore.Key, dst interface{}) error {
 	if key.Incomplete() {
 		return datastore.ErrInvalidKey
 	}
@@ -61,26 +197,49 @@ func (d *Database) Get(ctx context.Context, key *datastore.Key, dst interface{})
 }
 
 func (d *Database) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.put(key, src)
+}
+
+func (d *Database) put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	b, err := encode(src)
+	if err != nil {
+		return nil, err
+	}
 	if key.Incomplete() {
 		key.ID = rand.Int63()
 	}
-	fpath := d.fpath(key)
-	dir, _ := filepath.Split(fpath)
-	if err := os.MkdirAll(dir, 0777); err != nil {
+	if err := d.write(key, b); err != nil {
 		return nil, err
 	}
-	f, err := os.Create(fpath)
-	if err != nil {
+	return key, nil
+}
+
+func encode(src interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(src); err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	if err := json.NewEncoder(f).Encode(src); err != nil {
-		return nil, err
+	return buf.Bytes(), nil
+}
+
+func (d *Database) write(key *datastore.Key, b []byte) error {
+	fpath := d.fpath(key)
+	dir, _ := filepath.Split(fpath)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
 	}
-	return key, nil
+	return ioutil.WriteFile(fpath, b, 0666)
 }
 
 func (d *Database) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) (err error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return getMulti(keys, dst, d.get)
+}
+
+func getMulti(keys []*datastore.Key, dst interface{}, get func(*datastore.Key, interface{}) error) error {
 	v := reflect.ValueOf(dst)
 	multiArgType, _ := checkMultiArg(v)
 
@@ -114,7 +273,7 @@ func (d *Database) GetMulti(ctx context.Context, keys []*datastore.Key, dst inte
 		if multiArgType == multiArgTypeStructPtr && elem.IsNil() {
 			elem.Set(reflect.New(elem.Type().Elem()))
 		}
-		if err := d.Get(ctx, k, elem.Interface()); err != nil {
+		if err := get(k, elem.Interface()); err != nil {
 			if err == datastore.ErrNoSuchEntity {
 				multiErr[i] = datastore.ErrNoSuchEntity
 				any = true
@@ -132,6 +291,12 @@ func (d *Database) GetMulti(ctx context.Context, keys []*datastore.Key, dst inte
 }
 
 func (d *Database) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) (_ []*datastore.Key, err error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return putMulti(keys, src, d.put)
+}
+
+func putMulti(keys []*datastore.Key, src interface{}, put func(*datastore.Key, interface{}) (*datastore.Key, error)) ([]*datastore.Key, error) {
 	v := reflect.ValueOf(src)
 	multiArgType, _ := checkMultiArg(v)
 	if multiArgType == multiArgTypeInvalid {
@@ -153,7 +318,7 @@ func (d *Database) PutMulti(ctx context.Context, keys []*datastore.Key, src inte
 		if multiArgType == multiArgTypePropertyLoadSaver || multiArgType == multiArgTypeStruct {
 			elem = elem.Addr()
 		}
-		if _, err := d.Put(ctx, k, elem.Interface()); err != nil {
+		if _, err := put(k, elem.Interface()); err != nil {
 			multiErr[i] = err
 			hasErr = true
 		}
@@ -164,6 +329,296 @@ func (d *Database) PutMulti(ctx context.Context, keys []*datastore.Key, src inte
 	return keys, nil
 }
 
+func (d *Database) Delete(ctx context.Context, key *datastore.Key) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.delete(key)
+}
+
+func (d *Database) delete(key *datastore.Key) error {
+	if key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	if err := os.Remove(d.fpath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *Database) DeleteMulti(ctx context.Context, keys []*datastore.Key) (err error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return deleteMulti(keys, d.delete)
+}
+
+func deleteMulti(keys []*datastore.Key, del func(*datastore.Key) error) error {
+	multiErr, any := make(datastore.MultiError, len(keys)), false
+	for i, k := range keys {
+		if err := del(k); err != nil {
+			multiErr[i] = err
+			any = true
+		}
+	}
+	if any {
+		return multiErr
+	}
+	return nil
+}
+
+// Query walks all the files in the database, so it's slow for large databases.
+func (d *Database) Query(ctx context.Context, q services.Query, dst interface{}) ([]*datastore.Key, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	keys, err := d.keys(q)
+	if err != nil {
+		return nil, err
+	}
+	return query(q, keys, dst, d.get)
+}
+
+// keys returns the keys of the stored entities matching q.
+func (d *Database) keys(q services.Query) ([]*datastore.Key, error) {
+	var keys []*datastore.Key
+	err := filepath.Walk(d.root(), func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(fpath, ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root(), fpath)
+		if err != nil {
+			return err
+		}
+		key, err := decodePath(rel)
+		if err != nil {
+			return err
+		}
+		if matches(q, key) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// matches reports whether the key is selected by q.
+func matches(q services.Query, key *datastore.Key) bool {
+	if key.Kind != q.Kind {
+		return false
+	}
+	if q.Prefix != "" {
+		if key.Name == "" || !strings.HasPrefix(key.Name, q.Prefix) {
+			return false
+		}
+		if key.Parent == nil || q.Ancestor == nil {
+			return key.Parent == nil && q.Ancestor == nil
+		}
+		return key.Parent.Equal(q.Ancestor)
+	}
+	if q.Ancestor == nil {
+		return true
+	}
+	for k := key; k != nil; k = k.Parent {
+		if k.Equal(q.Ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// query sorts and limits the keys, and loads the entities into dst with get.
+func query(q services.Query, keys []*datastore.Key, dst interface{}, get func(*datastore.Key, interface{}) error) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, errors.New("datastore: dst must be a pointer to a slice")
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil, errors.New("datastore: dst must be a pointer to a slice of structs or struct pointers")
+	}
+	sort.Slice(keys, func(i, j int) bool { return compareKeys(keys[i], keys[j]) < 0 })
+	if q.Limit > 0 && len(keys) > q.Limit {
+		keys = keys[:q.Limit]
+	}
+	for _, key := range keys {
+		elem := reflect.New(elemType)
+		if err := get(key, elem.Interface()); err != nil {
+			return nil, err
+		}
+		if isPtr {
+			slice = reflect.Append(slice, elem)
+		} else {
+			slice = reflect.Append(slice, elem.Elem())
+		}
+	}
+	v.Elem().Set(slice)
+	return keys, nil
+}
+
+// compareKeys compares keys in datastore order: element by element from the root, by kind and then
+// ID or name, with IDs before names and ancestors before descendants.
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := path(a), path(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		ea, eb := pa[i], pb[i]
+		if c := strings.Compare(ea.Kind, eb.Kind); c != 0 {
+			return c
+		}
+		switch {
+		case ea.Name == "" && eb.Name != "":
+			return -1
+		case ea.Name != "" && eb.Name == "":
+			return 1
+		case ea.ID < eb.ID:
+			return -1
+		case ea.ID > eb.ID:
+			return 1
+		}
+		if c := strings.Compare(ea.Name, eb.Name); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// path returns the elements of the key from the root.
+func path(key *datastore.Key) []*datastore.Key {
+	var p []*datastore.Key
+	for k := key; k != nil; k = k.Parent {
+		p = append([]*datastore.Key{k}, p...)
+	}
+	return p
+}
+
+// RunInTransaction holds the lock of the database while f runs, and buffers the writes of f until
+// it returns. The writes are then applied one by one, so a transaction is atomic with respect to
+// other operations on the Database, but not if the process crashes.
+func (d *Database) RunInTransaction(ctx context.Context, f func(tx services.Database) error) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	t := &transaction{d: d, writes: map[string]*write{}}
+	if err := f(t); err != nil {
+		return err
+	}
+	for _, w := range t.writes {
+		if w.data == nil {
+			if err := d.delete(w.key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.write(w.key, w.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type transaction struct {
+	d      *Database
+	writes map[string]*write // by file path
+}
+
+// write is a buffered put, or a delete if data is nil.
+type write struct {
+	key  *datastore.Key
+	data []byte
+}
+
+func (t *transaction) get(key *datastore.Key, dst interface{}) error {
+	if key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	w, ok := t.writes[t.d.fpath(key)]
+	if !ok {
+		return t.d.get(key, dst)
+	}
+	if w.data == nil {
+		return datastore.ErrNoSuchEntity
+	}
+	return json.Unmarshal(w.data, dst)
+}
+
+func (t *transaction) put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	b, err := encode(src)
+	if err != nil {
+		return nil, err
+	}
+	if key.Incomplete() {
+		key.ID = rand.Int63()
+	}
+	t.writes[t.d.fpath(key)] = &write{key: key, data: b}
+	return key, nil
+}
+
+func (t *transaction) delete(key *datastore.Key) error {
+	if key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	t.writes[t.d.fpath(key)] = &write{key: key}
+	return nil
+}
+
+func (t *transaction) Get(ctx context.Context, key *datastore.Key, dst interface{}) (err error) {
+	return t.get(key, dst)
+}
+
+func (t *transaction) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return t.put(key, src)
+}
+
+func (t *transaction) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) (err error) {
+	return getMulti(keys, dst, t.get)
+}
+
+func (t *transaction) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) (_ []*datastore.Key, err error) {
+	return putMulti(keys, src, t.put)
+}
+
+func (t *transaction) Delete(ctx context.Context, key *datastore.Key) error {
+	return t.delete(key)
+}
+
+func (t *transaction) DeleteMulti(ctx context.Context, keys []*datastore.Key) (err error) {
+	return deleteMulti(keys, t.delete)
+}
+
+// Query sees the writes of the transaction.
+func (t *transaction) Query(ctx context.Context, q services.Query, dst interface{}) ([]*datastore.Key, error) {
+	stored, err := t.d.keys(q)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*datastore.Key
+	for _, key := range stored {
+		if _, ok := t.writes[t.d.fpath(key)]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	for _, w := range t.writes {
+		if w.data != nil && matches(q, w.key) {
+			keys = append(keys, w.key)
+		}
+	}
+	return query(q, keys, dst, t.get)
+}
+
+func (t *transaction) RunInTransaction(ctx context.Context, f func(tx services.Database) error) error {
+	return errors.New("nested transactions are not supported")
+}
+
 // checkMultiArg checks that v has type []S, []*S, []I, or []P, for some struct
 // type S, for some interface type I, or some non-interface non-pointer type P
 // such that P or *P implements PropertyLoadSaver.
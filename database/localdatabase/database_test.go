@@ -0,0 +1,81 @@
+package localdatabase
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/dave/services"
+	"github.com/dave/services/database/databasetest"
+)
+
+func TestConformance(t *testing.T) {
+	databasetest.Run(t, func(t *testing.T) (services.Database, func()) {
+		dir, err := ioutil.TempDir("", "localdatabase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return New(dir), func() { os.RemoveAll(dir) }
+	})
+}
+
+func TestDigitNames(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "localdatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := New(dir)
+	type entity struct{ Value string }
+	name, id := datastore.NameKey("Kind", "123", nil), datastore.IDKey("Kind", 123, nil)
+	if _, err := d.PutMulti(ctx, []*datastore.Key{name, id}, []entity{{"name"}, {"id"}}); err != nil {
+		t.Fatal(err)
+	}
+	var dst []entity
+	keys, err := d.Query(ctx, services.Query{Kind: "Kind", Prefix: "12"}, &dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[0].Equal(name) || dst[0].Value != "name" {
+		t.Fatalf("expected the name key, got %v %v", keys, dst)
+	}
+	var e entity
+	if err := d.Get(ctx, id, &e); err != nil || e.Value != "id" {
+		t.Fatalf("expected the id entity, got %v %v", e, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "localdatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	legacy := filepath.Join(dir, "datastore", "Kind")
+	if err := os.MkdirAll(legacy, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"a%2Fb.json": `{"Value":"a/b"}`, "5.json": `{"Value":"5"}`} {
+		if err := ioutil.WriteFile(filepath.Join(legacy, name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := New(dir)
+	type entity struct{ Value string }
+	dst := make([]entity, 2)
+	if err := d.GetMulti(ctx, []*datastore.Key{datastore.NameKey("Kind", "a/b", nil), datastore.IDKey("Kind", 5, nil)}, dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst[0].Value != "a/b" || dst[1].Value != "5" {
+		t.Fatalf("unexpected entities %v", dst)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "datastore")); !os.IsNotExist(err) {
+		t.Fatalf("expected the legacy directory to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dave/services/constor"
+)
+
+// CollectOutput summarises a garbage collection run.
+type CollectOutput struct {
+	Reachable int      // Number of package artifacts still referenced
+	Kept      int      // Number of unreferenced package artifacts kept because they're within the grace period
+	Deleted   []string // Names of the deleted package artifacts
+}
+
+var (
+	// collectable matches the immutable package and loader artifacts in the package bucket:
+	// <path>.<hash>.js and <path>.<hash>.ax, and their precompressed variants.
+	collectable = regexp.MustCompile(`^(.+\.[0-9a-f]{40}\.(js|ax))(\.gz|\.br)?$`)
+
+	// loaderJson matches the package list in a loader (see genMain)
+	loaderJson = regexp.MustCompile(`\{"path":"([^"]+)","hash":"([0-9a-f]+)"`)
+)
+
+// Collect deletes package artifacts that are no longer referenced. Every object in the index bucket is
+// treated as live: the loaders referenced by index files and live deploy manifests are walked to find
+// the reachable packages. Unreferenced artifacts are only deleted when they were last updated before
+// the grace period, which protects deploys in progress and packages sent to playground clients by
+// Update. In dry-run mode nothing is deleted.
+func (d *Deployer) Collect(ctx context.Context, grace time.Duration) (*CollectOutput, error) {
+
+	fs := d.session.Fileserver
+	reachable := map[string]bool{}
+	mark := func(path, hash string) {
+		reachable[fmt.Sprintf("%s.%s.js", path, hash)] = true
+		reachable[fmt.Sprintf("%s.%s.ax", path, hash)] = true
+	}
+
+	// The standard library and prelude are always reachable
+	for path, hashes := range d.index {
+		for _, hash := range hashes {
+			mark(path, hash)
+		}
+	}
+	for _, hash := range d.preludeHashes() {
+		mark("prelude", hash)
+	}
+
+	indexes, err := fs.List(ctx, d.config.IndexBucket, "")
+	if err != nil {
+		return nil, err
+	}
+
+	loaderUrl := regexp.MustCompile(regexp.QuoteMeta(d.config.PkgHost+"/") + `([^"'\s]+\.[0-9a-f]{40}\.js)`)
+	loaders := map[string]bool{}
+	indexHashes := map[string]string{}
+	var manifests [][]byte
+
+	for _, o := range indexes {
+		buf := &bytes.Buffer{}
+		if _, err := constor.Read(ctx, fs, d.config.IndexBucket, o.Name, buf); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(o.Name, "manifest/") {
+			manifests = append(manifests, buf.Bytes())
+			continue
+		}
+		indexHashes[o.Name] = fmt.Sprintf("%x", sha1.Sum(buf.Bytes()))
+		for _, match := range loaderUrl.FindAllStringSubmatch(buf.String(), -1) {
+			loaders[match[1]] = true
+		}
+	}
+
+	// Manifests find the loaders for index files generated from custom templates that don't include
+	// the loader URL. A build is live if any of its index files still has the same contents.
+	for _, b := range manifests {
+		var m Manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		for _, build := range m.Builds {
+			var live bool
+			for _, a := range build.Artifacts {
+				if a.Bucket == d.config.IndexBucket && indexHashes[a.Name] == a.Hash {
+					live = true
+					break
+				}
+			}
+			if !live {
+				continue
+			}
+			for _, a := range build.Artifacts {
+				if a.Bucket == d.config.PkgBucket && a.Hash == build.MainHash {
+					loaders[a.Name] = true
+				}
+			}
+		}
+	}
+
+	for name := range loaders {
+		reachable[name] = true
+		buf := &bytes.Buffer{}
+		found, err := constor.Read(ctx, fs, d.config.PkgBucket, name, buf)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		for _, match := range loaderJson.FindAllStringSubmatch(buf.String(), -1) {
+			mark(match[1], match[2])
+		}
+	}
+
+	objects, err := fs.List(ctx, d.config.PkgBucket, "")
+	if err != nil {
+		return nil, err
+	}
+
+	out := &CollectOutput{}
+	for _, o := range objects {
+		match := collectable.FindStringSubmatch(o.Name)
+		if match == nil {
+			continue
+		}
+		if reachable[match[1]] {
+			out.Reachable++
+			continue
+		}
+		if time.Since(o.Updated) < grace {
+			out.Kept++
+			continue
+		}
+		if !d.config.DryRun {
+			if _, err := fs.Delete(ctx, d.config.PkgBucket, o.Name); err != nil {
+				return nil, err
+			}
+			if d.config.Storage.Known != nil {
+				d.config.Storage.Known.Forget(d.config.PkgBucket, o.Name)
+			}
+		}
+		out.Deleted = append(out.Deleted, o.Name)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,235 @@
+package deployer
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dave/services"
+	"github.com/dave/services/constor"
+	"github.com/dave/services/fileserver/cachefileserver"
+	"github.com/dave/services/session"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+)
+
+// testDeployer returns a Deployer with an in-memory fileserver. Objects should be stored with store, so
+// they're stored with the storage options of the deployer.
+func testDeployer(config Config) (*Deployer, services.Fileserver) {
+	fs := cachefileserver.New(1<<24, 1<<24)
+	config.IndexBucket = "index"
+	config.PkgBucket = "pkg"
+	config.PkgProtocol = "https"
+	config.PkgHost = "pkg.host"
+	if config.Storage.Workers == 0 {
+		config.Storage.Workers = 1
+	}
+	s := session.New(nil, memfs.New(), nil, fs, nil)
+	d := New(s, func(services.Message) {}, nil, map[bool]string{true: hash("prelude")}, config)
+	return d, fs
+}
+
+// store stores the objects in bucket as a deploy would.
+func store(t *testing.T, d *Deployer, bucket string, objects map[string]string) {
+	t.Helper()
+	storer, _ := d.newStorer(context.Background())
+	defer storer.Close()
+	for name, contents := range objects {
+		storer.Add(constor.Item{Bucket: bucket, Name: name, Contents: []byte(contents)})
+	}
+	if err := storer.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hash(s string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s)))
+}
+
+// storeLive stores an index that references a loader of package a, and an unreferenced package b. It
+// returns the names of the reachable package artifacts and the unreachable one.
+func storeLive(t *testing.T, d *Deployer) (reachable []string, unreachable string) {
+	loader := fmt.Sprintf("a.%s.js", hash("loader"))
+	pkg := fmt.Sprintf("a.%s", hash("a"))
+	store(t, d, d.config.IndexBucket, map[string]string{
+		"a": fmt.Sprintf(`<script src="https://pkg.host/%s"></script>`, loader),
+	})
+	store(t, d, d.config.PkgBucket, map[string]string{
+		loader:                                  fmt.Sprintf(`var info = [{"path":"a","hash":"%s"}];`, hash("a")),
+		pkg + ".js":                             "a",
+		pkg + ".ax":                             "a",
+		fmt.Sprintf("b.%s.js", hash("b")):       "b",
+		fmt.Sprintf("prelude.%s.js", hash("p")): "old prelude",
+	})
+	return []string{loader, pkg + ".js", pkg + ".ax"}, fmt.Sprintf("b.%s.js", hash("b"))
+}
+
+func TestCollect(t *testing.T) {
+	d, fs := testDeployer(Config{})
+	reachable, unreachable := storeLive(t, d)
+	out, err := d.Collect(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Reachable != len(reachable) || out.Kept != 0 || len(out.Deleted) != 2 {
+		t.Fatalf("expected %d reachable, 0 kept and 2 deleted, got %#v", len(reachable), out)
+	}
+	for _, name := range reachable {
+		if exists, _ := fs.Exists(context.Background(), d.config.PkgBucket, name); !exists {
+			t.Fatalf("expected %s to be kept", name)
+		}
+	}
+	for _, name := range []string{unreachable, fmt.Sprintf("prelude.%s.js", hash("p"))} {
+		if exists, _ := fs.Exists(context.Background(), d.config.PkgBucket, name); exists {
+			t.Fatalf("expected %s to be deleted", name)
+		}
+	}
+	// the registered prelude is always reachable
+	store(t, d, d.config.PkgBucket, map[string]string{fmt.Sprintf("prelude.%s.js", hash("prelude")): "prelude"})
+	out, err = d.Collect(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Reachable != len(reachable)+1 || len(out.Deleted) != 0 {
+		t.Fatalf("expected %d reachable and none deleted, got %#v", len(reachable)+1, out)
+	}
+}
+
+func TestCollectManifest(t *testing.T) {
+	d, fs := testDeployer(Config{})
+	live := fmt.Sprintf("c.%s.js", hash("live loader"))
+	stale := fmt.Sprintf("c.%s.js", hash("stale loader"))
+	index := "<html>custom template without the loader url</html>"
+	manifest := func(loader, indexHash string) string {
+		b, err := json.Marshal(Manifest{Path: "c", Builds: []*ManifestBuild{{
+			MainHash: hash(loader),
+			Artifacts: []*ManifestArtifact{
+				{Bucket: d.config.IndexBucket, Name: "c", Hash: indexHash},
+				{Path: "c", Bucket: d.config.PkgBucket, Name: fmt.Sprintf("c.%s.js", hash(loader)), Hash: hash(loader)},
+			},
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	store(t, d, d.config.IndexBucket, map[string]string{
+		"c":                 index,
+		"manifest/c.1.json": manifest("live loader", hash(index)),
+		"manifest/c.2.json": manifest("stale loader", hash("previous index")),
+	})
+	store(t, d, d.config.PkgBucket, map[string]string{
+		live:                                  fmt.Sprintf(`var info = [{"path":"c","hash":"%s"}];`, hash("c")),
+		stale:                                 fmt.Sprintf(`var info = [{"path":"c","hash":"%s"}];`, hash("old c")),
+		fmt.Sprintf("c.%s.js", hash("c")):     "c",
+		fmt.Sprintf("c.%s.js", hash("old c")): "old c",
+	})
+	out, err := d.Collect(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out.Deleted)
+	expected := []string{stale, fmt.Sprintf("c.%s.js", hash("old c"))}
+	sort.Strings(expected)
+	if out.Reachable != 2 || fmt.Sprint(out.Deleted) != fmt.Sprint(expected) {
+		t.Fatalf("expected 2 reachable and %v deleted, got %#v", expected, out)
+	}
+	for _, name := range []string{live, fmt.Sprintf("c.%s.js", hash("c"))} {
+		if exists, _ := fs.Exists(context.Background(), d.config.PkgBucket, name); !exists {
+			t.Fatalf("expected %s to be kept", name)
+		}
+	}
+}
+
+func TestCollectGrace(t *testing.T) {
+	d, fs := testDeployer(Config{})
+	reachable, unreachable := storeLive(t, d)
+	out, err := d.Collect(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Reachable != len(reachable) || out.Kept != 2 || len(out.Deleted) != 0 {
+		t.Fatalf("expected %d reachable, 2 kept and none deleted, got %#v", len(reachable), out)
+	}
+	if exists, _ := fs.Exists(context.Background(), d.config.PkgBucket, unreachable); !exists {
+		t.Fatalf("expected %s to be kept", unreachable)
+	}
+}
+
+func TestCollectDryRun(t *testing.T) {
+	d, fs := testDeployer(Config{})
+	_, unreachable := storeLive(t, d)
+	// objects are stored first, because a dry run doesn't store them
+	d.config.DryRun = true
+	out, err := d.Collect(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out.Deleted)
+	expected := []string{unreachable, fmt.Sprintf("prelude.%s.js", hash("p"))}
+	sort.Strings(expected)
+	if fmt.Sprint(out.Deleted) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v reported, got %v", expected, out.Deleted)
+	}
+	for _, name := range expected {
+		if exists, _ := fs.Exists(context.Background(), d.config.PkgBucket, name); !exists {
+			t.Fatalf("expected %s not to be deleted", name)
+		}
+	}
+}
+
+func TestCollectEncoded(t *testing.T) {
+	for _, encoding := range []constor.Encoding{nil, constor.Gzip, constor.Brotli} {
+		d, fs := testDeployer(Config{Storage: constor.Options{Encoding: encoding}})
+		reachable, unreachable := storeLive(t, d)
+		out, err := d.Collect(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Reachable != len(reachable) {
+			t.Fatalf("%v: expected %d reachable, got %d", encoding, len(reachable), out.Reachable)
+		}
+		sort.Strings(out.Deleted)
+		expected := []string{unreachable, fmt.Sprintf("prelude.%s.js", hash("p"))}
+		sort.Strings(expected)
+		if fmt.Sprint(out.Deleted) != fmt.Sprint(expected) {
+			t.Fatalf("%v: expected %v deleted, got %v", encoding, expected, out.Deleted)
+		}
+		for _, name := range reachable {
+			if exists, _ := fs.Exists(context.Background(), d.config.PkgBucket, name); !exists {
+				t.Fatalf("%v: expected %s to be kept", encoding, name)
+			}
+		}
+	}
+}
+
+func TestCollectAddPrelude(t *testing.T) {
+	d, _ := testDeployer(Config{})
+	storeLive(t, d)
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		close(started)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			d.AddPrelude(fmt.Sprint(i%10), map[bool]string{true: hash(fmt.Sprint(i))})
+		}
+	}()
+	<-started
+	for i := 0; i < 10; i++ {
+		if _, err := d.Collect(context.Background(), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+}
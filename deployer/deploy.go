@@ -5,11 +5,13 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
@@ -21,10 +23,27 @@ import (
 	"gopkg.in/src-d/go-billy.v4/memfs"
 )
 
-// Deploy compiles and deploys path.
+// Deploy compiles and deploys path. The minified and un-minified variants are built concurrently and
+// share a context: if either fails, the other is cancelled and no further artifacts are stored.
 func (d *Deployer) Deploy(ctx context.Context, path string, index IndexType, minified map[bool]bool) (map[bool]*DeployOutput, error) {
 
-	storer := constor.New(ctx, d.session.Fileserver, d.send, d.config.ConcurrentStorageUploads)
+	if d.config.SigningKey != nil && index == HashIndex {
+		// the index passes expiring signatures to the loader, so it can't be immutable
+		return nil, errors.New("private deployments (with SigningKey) don't support HashIndex")
+	}
+
+	for min, ok := range minified {
+		if ok {
+			if err := d.checkPrelude(min); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	storer, recorder := d.newStorer(ctx)
 	defer storer.Close()
 
 	d.send(buildermsg.Building{Starting: true})
@@ -32,29 +51,30 @@ func (d *Deployer) Deploy(ctx context.Context, path string, index IndexType, min
 
 	wg := &sync.WaitGroup{}
 
-	outputs := map[bool]*builder.CommandOutput{}
-	mainHashes := map[bool][]byte{}
-	indexHashes := map[bool][]byte{}
+	var m sync.Mutex // protects out and manifest
+	out := map[bool]*DeployOutput{}
+	manifest := &Manifest{Path: path, Index: index}
 
-	var outer error
+	errs := &collector{cancel: cancel}
+	fail := errs.fail
 
 	do := func(min bool) {
 		defer wg.Done()
 
-		var err error
-		var data *builder.PackageData
+		build := d.newManifestBuild(min)
+		storer := &manifestStorer{Storer: storer, build: build}
 
-		data, outputs[min], err = d.compileAndStore(ctx, path, storer, min)
+		data, output, err := d.compileAndStore(ctx, path, storer, min)
 		if err != nil {
-			outer = err
+			fail(err)
 			return
 		}
 
 		d.send(buildermsg.Building{Message: "Loader"})
 
-		mainHashes[min], err = d.genMain(ctx, storer, outputs[min], min)
+		mainHash, err := d.genMain(ctx, storer, output, min)
 		if err != nil {
-			outer = err
+			fail(err)
 			return
 		}
 
@@ -62,15 +82,27 @@ func (d *Deployer) Deploy(ctx context.Context, path string, index IndexType, min
 
 		tpl, err := d.getIndexTpl(data.Dir)
 		if err != nil {
-			outer = err
+			fail(err)
 			return
 		}
 
-		indexHashes[min], err = d.genIndex(storer, tpl, path, mainHashes[min], min, index)
+		indexHash, err := d.genIndex(storer, tpl, path, output, mainHash, min, index)
 		if err != nil {
-			outer = err
+			fail(err)
 			return
 		}
+
+		build.MainHash = fmt.Sprintf("%x", mainHash)
+		build.IndexHash = fmt.Sprintf("%x", indexHash)
+
+		m.Lock()
+		defer m.Unlock()
+		out[min] = &DeployOutput{
+			CommandOutput: output,
+			MainHash:      mainHash,
+			IndexHash:     indexHash,
+		}
+		manifest.Builds = append(manifest.Builds, build)
 	}
 
 	if minified[true] {
@@ -87,8 +119,8 @@ func (d *Deployer) Deploy(ctx context.Context, path string, index IndexType, min
 
 	wg.Wait()
 
-	if outer != nil {
-		return nil, outer
+	if err := errs.err(); err != nil {
+		return nil, err
 	}
 
 	d.send(buildermsg.Building{Done: true})
@@ -97,21 +129,103 @@ func (d *Deployer) Deploy(ctx context.Context, path string, index IndexType, min
 		return nil, err
 	}
 
+	// The manifest is stored last so it records whether each artifact was stored or unchanged.
+	sort.Slice(manifest.Builds, func(i, j int) bool {
+		return manifest.Builds[i].Minified && !manifest.Builds[j].Minified
+	})
+	name, err := d.storeManifest(storer, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := storer.Wait(); err != nil {
+		return nil, err
+	}
+	for _, o := range out {
+		o.Manifest = name
+	}
+
 	d.send(constormsg.Storing{Done: true})
 
-	out := map[bool]*DeployOutput{}
-	for min := range outputs {
-		out[min] = &DeployOutput{
-			CommandOutput: outputs[min],
-			MainHash:      mainHashes[min],
-			IndexHash:     indexHashes[min],
-		}
+	if recorder != nil {
+		d.send(recorder.report())
 	}
 
 	return out, nil
 
 }
 
+// Errors is returned by Deploy when more than one variant fails.
+type Errors []error
+
+func (e Errors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Err returns nil if there are no errors, the error itself if there's only one, or e.
+func (e Errors) Err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+// collector collects the errors of the concurrently deployed variants. The first error cancels the
+// context to stop the other variant. If the other variant then fails with context.Canceled the error is
+// caused by our cancel, so it's dropped, but any other failure is kept.
+type collector struct {
+	m      sync.Mutex
+	errs   Errors
+	cancel context.CancelFunc
+}
+
+func (c *collector) fail(err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if len(c.errs) > 0 && isCanceled(err) {
+		return
+	}
+	c.errs = append(c.errs, err)
+	c.cancel()
+}
+
+// isCanceled reports whether err is context.Canceled, or is caused only by context.Canceled (e.g. when
+// all the items a storer failed to store were cancelled). Wrapped errors are unwrapped with Cause or
+// Unwrap.
+func isCanceled(err error) bool {
+	if err == context.Canceled {
+		return true
+	}
+	switch e := err.(type) {
+	case *constor.Error:
+		return isCanceled(e.Err)
+	case constor.Errors:
+		for _, item := range e {
+			if !isCanceled(item) {
+				return false
+			}
+		}
+		return len(e) > 0
+	case interface{ Cause() error }:
+		return isCanceled(e.Cause())
+	case interface{ Unwrap() error }:
+		return isCanceled(e.Unwrap())
+	}
+	return false
+}
+
+func (c *collector) err() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.errs.Err()
+}
+
 type IndexType int
 
 const (
@@ -122,6 +236,7 @@ const (
 type DeployOutput struct {
 	*builder.CommandOutput
 	MainHash, IndexHash []byte
+	Manifest            string // Name of the deploy manifest in the index bucket
 }
 
 func (d *Deployer) defaultOptions(min bool) *builder.Options {
@@ -136,20 +251,9 @@ func (d *Deployer) defaultOptions(min bool) *builder.Options {
 	}
 }
 
-func (d *Deployer) compileAndStore(ctx context.Context, path string, storer *constor.Storer, min bool) (*builder.PackageData, *builder.CommandOutput, error) {
-
-	b := builder.New(d.session, d.defaultOptions(min))
-
-	data, archive, err := b.BuildImportPath(ctx, path)
-	if err != nil {
-		return nil, nil, err
-	}
+func (d *Deployer) compileAndStore(ctx context.Context, path string, storer *manifestStorer, min bool) (*builder.PackageData, *builder.CommandOutput, error) {
 
-	if archive.Name != "main" {
-		return nil, nil, fmt.Errorf("can't compile - %s is not a main package", path)
-	}
-
-	output, err := b.WriteCommandPackage(ctx, archive)
+	data, output, err := d.compile(ctx, path, min)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -158,7 +262,7 @@ func (d *Deployer) compileAndStore(ctx context.Context, path string, storer *con
 		if !po.Store {
 			continue
 		}
-		storer.Add(constor.Item{
+		storer.Add(po.Path, fmt.Sprintf("%x", po.Hash), constor.Item{
 			Message:   po.Path,
 			Name:      fmt.Sprintf("%s.%x.js", po.Path, po.Hash),
 			Contents:  po.Contents,
@@ -173,6 +277,27 @@ func (d *Deployer) compileAndStore(ctx context.Context, path string, storer *con
 	return data, output, nil
 }
 
+func (d *Deployer) compile(ctx context.Context, path string, min bool) (*builder.PackageData, *builder.CommandOutput, error) {
+
+	b := builder.New(d.session, d.defaultOptions(min))
+
+	data, archive, err := b.BuildImportPath(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if archive.Name != "main" {
+		return nil, nil, fmt.Errorf("can't compile - %s is not a main package", path)
+	}
+
+	output, err := b.WriteCommandPackage(ctx, archive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, output, nil
+}
+
 func (d *Deployer) getIndexTpl(dir string) (*template.Template, error) {
 	fs := d.session.Filesystem(dir)
 	fname := filepath.Join(dir, "index.jsgo.html")
@@ -203,6 +328,11 @@ type IndexVars struct {
 	Path   string
 	Hash   string
 	Script string
+
+	// Signatures is a script element that passes the signed queries of the packages to the loader, or
+	// empty if the deployment isn't private. Index templates of private deployments must include it
+	// before the loader script.
+	Signatures string
 }
 
 var indexTemplate = template.Must(template.New("main").Parse(`
@@ -221,30 +351,63 @@ var indexTemplate = template.Must(template.New("main").Parse(`
 				}
 			}
 		</script>
+		{{ .Signatures }}
 		<script src="{{ .Script }}"></script>
 	</body>
 </html>
 `))
 
-func (d *Deployer) genIndex(storer *constor.Storer, tpl *template.Template, path string, loaderHash []byte, min bool, index IndexType) ([]byte, error) {
+// renderIndex executes the index template. pkgUrl is the URL of the package bucket including the
+// trailing slash. signatures are the signed queries of the loader and packages by object name, or nil
+// if the deployment isn't private.
+func renderIndex(tpl *template.Template, path string, loaderHash []byte, pkgUrl string, signatures map[string]string) (*bytes.Buffer, []byte, error) {
 
+	loader := fmt.Sprintf("%s.%x.js", path, loaderHash)
 	v := IndexVars{
 		Path:   path,
 		Hash:   fmt.Sprintf("%x", loaderHash),
-		Script: fmt.Sprintf("%s://%s/%s.%x.js", d.config.PkgProtocol, d.config.PkgHost, path, loaderHash),
+		Script: pkgUrl + loader,
+	}
+	if signatures != nil {
+		v.Script += "?" + signatures[loader]
+		b, err := json.Marshal(signatures)
+		if err != nil {
+			return nil, nil, err
+		}
+		v.Signatures = fmt.Sprintf("<script>var $signatures = %s;</script>", b)
 	}
 
 	buf := &bytes.Buffer{}
 	sha := sha1.New()
 
 	if err := tpl.Execute(io.MultiWriter(buf, sha), v); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	indexHash := sha.Sum(nil)
+	return buf, sha.Sum(nil), nil
+}
+
+func (d *Deployer) genIndex(storer *manifestStorer, tpl *template.Template, path string, output *builder.CommandOutput, loaderHash []byte, min bool, index IndexType) ([]byte, error) {
+
+	var signatures map[string]string
+	if d.config.SigningKey != nil {
+		// The signatures are in the index rather than the loader, so the loader stays immutable. The
+		// index is stored with no-cache, so it's fetched again once the signatures expire.
+		loader := fmt.Sprintf("%s.%x.js", path, loaderHash)
+		signatures = map[string]string{loader: d.SignedQuery(loader)}
+		for _, p := range d.loaderPackages(output, min) {
+			name := fmt.Sprintf("%s.%s.js", p.Path, p.Hash)
+			signatures[name] = d.SignedQuery(name)
+		}
+	}
+
+	buf, indexHash, err := renderIndex(tpl, path, loaderHash, d.pkgUrl(), signatures)
+	if err != nil {
+		return nil, err
+	}
 
 	if index == HashIndex {
-		storer.Add(constor.Item{
+		storer.Add("", fmt.Sprintf("%x", indexHash), constor.Item{
 			Message:   "Index",
 			Name:      fmt.Sprintf("%x", indexHash),
 			Contents:  buf.Bytes(),
@@ -254,7 +417,7 @@ func (d *Deployer) genIndex(storer *constor.Storer, tpl *template.Template, path
 			Immutable: true,
 			Send:      true,
 		})
-		storer.Add(constor.Item{
+		storer.Add("", fmt.Sprintf("%x", indexHash), constor.Item{
 			Message:   "",
 			Name:      fmt.Sprintf("%x/index.html", indexHash),
 			Contents:  buf.Bytes(),
@@ -265,82 +428,113 @@ func (d *Deployer) genIndex(storer *constor.Storer, tpl *template.Template, path
 			Send:      true,
 		})
 	} else {
-		fullpath := path
-		if !min {
-			fullpath = fmt.Sprintf("%s$max", path)
-		}
-		shortpath := strings.TrimPrefix(fullpath, "github.com/")
-
-		storer.Add(constor.Item{
-			Message:   "Index",
-			Name:      shortpath,
-			Contents:  buf.Bytes(),
-			Bucket:    d.config.IndexBucket,
-			Mime:      constor.MimeHtml,
-			Count:     false,
-			Immutable: false,
-		})
-		storer.Add(constor.Item{
-			Message:   "",
-			Name:      fmt.Sprintf("%s/index.html", shortpath),
-			Contents:  buf.Bytes(),
-			Bucket:    d.config.IndexBucket,
-			Mime:      constor.MimeHtml,
-			Count:     false,
-			Immutable: false,
-		})
-
-		if shortpath != fullpath {
-			storer.Add(constor.Item{
-				Message:   "",
-				Name:      fullpath,
+		add := func(bucket, name string, message string) {
+			storer.Add("", fmt.Sprintf("%x", indexHash), constor.Item{
+				Message:   message,
+				Name:      name,
 				Contents:  buf.Bytes(),
-				Bucket:    d.config.IndexBucket,
-				Mime:      constor.MimeHtml,
-				Count:     false,
-				Immutable: false,
-			})
-			storer.Add(constor.Item{
-				Message:   "",
-				Name:      fmt.Sprintf("%s/index.html", fullpath),
-				Contents:  buf.Bytes(),
-				Bucket:    d.config.IndexBucket,
+				Bucket:    bucket,
 				Mime:      constor.MimeHtml,
 				Count:     false,
 				Immutable: false,
 			})
 		}
+		message := "Index"
+		for _, name := range d.indexNames(path, min) {
+			add(d.config.IndexBucket, name, message)
+			add(d.config.IndexBucket, fmt.Sprintf("%s/index.html", name), "")
+			message = ""
+		}
+		if bucket, ok := d.config.Domains[path]; ok {
+			// The minified build is served from the root of the custom domain, and the un-minified build
+			// from $max.
+			if min {
+				add(bucket, "index.html", "")
+			} else {
+				add(bucket, "$max", "")
+				add(bucket, "$max/index.html", "")
+			}
+		}
 	}
 
 	return indexHash, nil
 
 }
 
-func (d *Deployer) genMain(ctx context.Context, storer *constor.Storer, output *builder.CommandOutput, min bool) ([]byte, error) {
-
-	preludeHash := d.prelude[min]
-	pkgs := []PkgJson{
-		{
-			// Always include the prelude dummy package first
-			Path: "prelude",
-			Hash: preludeHash,
-		},
+// indexNames returns the names a path index is stored under in the index bucket: the full path
+// followed by each distinct alias.
+func (d *Deployer) indexNames(path string, min bool) []string {
+	fullpath := path
+	if !min {
+		fullpath = fmt.Sprintf("%s$max", path)
 	}
-	for _, po := range output.Packages {
-		pkgs = append(pkgs, PkgJson{
-			Path: po.Path,
-			Hash: fmt.Sprintf("%x", po.Hash),
-		})
+	aliases := d.config.Aliases
+	if aliases == nil {
+		aliases = DefaultAliases
+	}
+	names := []string{fullpath}
+	done := map[string]bool{fullpath: true}
+	for _, a := range aliases {
+		if !strings.HasPrefix(fullpath, a.Prefix) {
+			continue
+		}
+		name := a.Replace + strings.TrimPrefix(fullpath, a.Prefix)
+		if done[name] {
+			continue
+		}
+		done[name] = true
+		names = append(names, name)
 	}
+	return names
+}
+
+// pkgUrl is the URL of the package bucket including the trailing slash.
+func (d *Deployer) pkgUrl() string {
+	return fmt.Sprintf("%s://%s/", d.config.PkgProtocol, d.config.PkgHost)
+}
 
-	pkgJson, err := json.Marshal(pkgs)
+func (d *Deployer) genMain(ctx context.Context, storer *manifestStorer, output *builder.CommandOutput, min bool) ([]byte, error) {
+
+	contents, hash, err := d.renderLoader(output, min, d.pkgUrl(), d.config.SigningKey != nil)
 	if err != nil {
 		return nil, err
 	}
 
+	var message string
+	if min {
+		message = "Loader (minified)"
+	} else {
+		message = "Loader (un-minified)"
+	}
+	storer.Add(output.Path, fmt.Sprintf("%x", hash), constor.Item{
+		Message:   message,
+		Name:      fmt.Sprintf("%s.%x.js", output.Path, hash),
+		Contents:  contents,
+		Bucket:    d.config.PkgBucket,
+		Mime:      constor.MimeJs,
+		Count:     true,
+		Immutable: true,
+		Send:      true,
+	})
+
+	return hash, nil
+}
+
+// renderLoader executes the loader template. pkgUrl is the URL of the package bucket including the
+// trailing slash. If signed is true, the package URLs are signed with the queries the index passes in
+// $signatures (see renderIndex).
+func (d *Deployer) renderLoader(output *builder.CommandOutput, min bool, pkgUrl string, signed bool) (contents, hash []byte, err error) {
+
+	pkgJson, err := json.Marshal(d.loaderPackages(output, min))
+	if err != nil {
+		return nil, nil, err
+	}
+
 	m := MainVars{
 		PkgProtocol: d.config.PkgProtocol,
 		PkgHost:     d.config.PkgHost,
+		PkgUrl:      pkgUrl,
+		Signed:      signed,
 		Path:        output.Path,
 		Json:        string(pkgJson),
 	}
@@ -353,34 +547,34 @@ func (d *Deployer) genMain(ctx context.Context, storer *constor.Storer, output *
 		tmpl = mainTemplate
 	}
 	if err := tmpl.Execute(buf, m); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	s := sha1.New()
 	if _, err := s.Write(buf.Bytes()); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	hash := s.Sum(nil)
+	return buf.Bytes(), s.Sum(nil), nil
+}
 
-	var message string
-	if min {
-		message = "Loader (minified)"
-	} else {
-		message = "Loader (un-minified)"
+// loaderPackages returns the packages the loader fetches, in load order.
+func (d *Deployer) loaderPackages(output *builder.CommandOutput, min bool) []PkgJson {
+	pkgs := []PkgJson{
+		{
+			// Always include the prelude dummy package first
+			Path:    "prelude",
+			Hash:    d.preludeHash(min),
+			Version: d.preludeVersion(),
+		},
 	}
-	storer.Add(constor.Item{
-		Message:   message,
-		Name:      fmt.Sprintf("%s.%x.js", output.Path, hash),
-		Contents:  buf.Bytes(),
-		Bucket:    d.config.PkgBucket,
-		Mime:      constor.MimeJs,
-		Count:     true,
-		Immutable: true,
-		Send:      true,
-	})
-
-	return hash, nil
+	for _, po := range output.Packages {
+		pkgs = append(pkgs, PkgJson{
+			Path: po.Path,
+			Hash: fmt.Sprintf("%x", po.Hash),
+		})
+	}
+	return pkgs
 }
 
 type MainVars struct {
@@ -388,17 +582,20 @@ type MainVars struct {
 	Json        string
 	PkgHost     string
 	PkgProtocol string
+	PkgUrl      string // PkgProtocol://PkgHost/ or a relative URL for exported sites
+	Signed      bool   // Package URLs are signed with the queries in $signatures
 }
 
 type PkgJson struct {
-	Path string `json:"path"`
-	Hash string `json:"hash"`
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+	Version string `json:"version,omitempty"` // Compiler version of the prelude
 }
 
 // minify with https://skalman.github.io/UglifyJS-online/
 
 var mainTemplateMinified = template.Must(template.New("main").Parse(
-	`"use strict";var $mainPkg,$load={};!function(){for(var n=0,t=0,e={{ .Json }},o=(document.getElementById("log"),function(){n++,window.jsgoProgress&&window.jsgoProgress(n,t),n==t&&function(){for(var n=0;n<e.length;n++)$load[e[n].path]();$mainPkg=$packages["{{ .Path }}"],$synthesizeMethods(),$packages.runtime.$init(),$go($mainPkg.$init,[]),$flushConsole()}()}),a=function(n){t++;var e=document.createElement("script");e.src=n,e.onload=o,e.onreadystatechange=o,document.head.appendChild(e)},s=0;s<e.length;s++)a("{{ .PkgProtocol }}://{{ .PkgHost }}/"+e[s].path+"."+e[s].hash+".js")}();`,
+	`"use strict";var $mainPkg,$load={};!function(){for(var n=0,t=0,e={{ .Json }},o=(document.getElementById("log"),function(){n++,window.jsgoProgress&&window.jsgoProgress(n,t),n==t&&function(){for(var n=0;n<e.length;n++)$load[e[n].path]();$mainPkg=$packages["{{ .Path }}"],$synthesizeMethods(),$packages.runtime.$init(),$go($mainPkg.$init,[]),$flushConsole()}()}),a=function(n){t++;var e=document.createElement("script");e.src=n,e.onload=o,e.onreadystatechange=o,document.head.appendChild(e)},s=0;s<e.length;s++)a("{{ .PkgUrl }}"+e[s].path+"."+e[s].hash+".js"{{ if .Signed }}+"?"+$signatures[e[s].path+"."+e[s].hash+".js"]{{ end }})}();`,
 ))
 var mainTemplate = template.Must(template.New("main").Parse(`"use strict";
 var $mainPkg;
@@ -433,6 +630,7 @@ var $load = {};
 		document.head.appendChild(tag);
 	}
 	for (var i = 0; i < info.length; i++) {
-		get("{{ .PkgProtocol }}://{{ .PkgHost }}/" + info[i].path + "." + info[i].hash + ".js");
+		var name = info[i].path + "." + info[i].hash + ".js";
+		get("{{ .PkgUrl }}" + name{{ if .Signed }} + "?" + $signatures[name]{{ end }});
 	}
 })();`))
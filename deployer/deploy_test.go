@@ -0,0 +1,220 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dave/services/builder"
+	"github.com/dave/services/constor"
+)
+
+func TestCollectorBothFail(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &collector{cancel: cancel}
+	min, max := errors.New("minified failed"), errors.New("un-minified failed")
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.fail(min)
+	}()
+	go func() {
+		defer wg.Done()
+		// the other variant notices the cancellation, but fails with a real error
+		<-ctx.Done()
+		c.fail(max)
+	}()
+	wg.Wait()
+	errs, ok := c.err().(Errors)
+	if !ok || len(errs) != 2 || errs[0] != min || errs[1] != max {
+		t.Fatalf("expected both errors, got %v", c.err())
+	}
+}
+
+func TestCollectorCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &collector{cancel: cancel}
+	failed := errors.New("failed")
+	c.fail(failed)
+	if ctx.Err() == nil {
+		t.Fatal("expected the first error to cancel the context")
+	}
+	// the other variant fails because of our cancel
+	c.fail(ctx.Err())
+	if err := c.err(); err != failed {
+		t.Fatalf("expected %v, got %v", failed, err)
+	}
+}
+
+// wrapped is an error that wraps another, like the errors of github.com/pkg/errors or go1.13.
+type wrapped struct{ err error }
+
+func (w wrapped) Error() string { return "wrapped: " + w.err.Error() }
+func (w wrapped) Unwrap() error { return w.err }
+
+func TestCollectorWrappedCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &collector{cancel: cancel}
+	failed := errors.New("failed")
+	c.fail(failed)
+	// the storer of the other variant reports the cancelled items
+	c.fail(constor.Errors{{Bucket: "pkg", Name: "a", Err: ctx.Err()}, {Bucket: "pkg", Name: "b", Err: wrapped{ctx.Err()}}})
+	if err := c.err(); err != failed {
+		t.Fatalf("expected %v, got %v", failed, err)
+	}
+	// a storer error that isn't only cancellations is kept
+	mixed := constor.Errors{{Bucket: "pkg", Name: "a", Err: ctx.Err()}, {Bucket: "pkg", Name: "b", Err: errors.New("permanent")}}
+	c.fail(mixed)
+	if errs, ok := c.err().(Errors); !ok || len(errs) != 2 {
+		t.Fatalf("expected both errors, got %v", c.err())
+	}
+}
+
+func TestIsCanceled(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{errors.New("failed"), false},
+		{context.Canceled, true},
+		{context.DeadlineExceeded, false},
+		{wrapped{context.Canceled}, true},
+		{wrapped{wrapped{context.Canceled}}, true},
+		{&constor.Error{Err: context.Canceled}, true},
+		{constor.Errors{}, false},
+		{constor.Errors{{Err: context.Canceled}, {Err: wrapped{context.Canceled}}}, true},
+		{constor.Errors{{Err: context.Canceled}, {Err: errors.New("failed")}}, false},
+	} {
+		if found := isCanceled(test.err); found != test.expected {
+			t.Fatalf("%#v: expected %v, got %v", test.err, test.expected, found)
+		}
+	}
+}
+
+func TestSignedLoader(t *testing.T) {
+	output := &builder.CommandOutput{
+		Path:     "a",
+		Packages: []*builder.PackageOutput{{Path: "a", Hash: []byte{1}}},
+	}
+	loaderHash := func(expiry time.Duration) []byte {
+		d := New(nil, nil, nil, nil, Config{SigningKey: []byte("key"), SignedUrlExpiry: expiry})
+		d.AddPrelude(d.preludeVersion(), map[bool]string{true: "p"})
+		_, hash, err := d.renderLoader(output, true, "https://pkg/", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	// the loader doesn't contain signatures, so it doesn't change when they do
+	if !bytes.Equal(loaderHash(time.Hour), loaderHash(48*time.Hour)) {
+		t.Fatal("expected the loader to be independent of the signatures")
+	}
+}
+
+func TestSignedIndex(t *testing.T) {
+	loader := fmt.Sprintf("a.%x.js", []byte{2})
+	signatures := map[string]string{loader: "sig=loader", "a.01.js": "sig=a"}
+	buf, _, err := renderIndex(indexTemplate, "a", []byte{2}, "https://pkg/", signatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := buf.String()
+	if !strings.Contains(index, `<script src="https://pkg/`+loader+`?sig=loader">`) {
+		t.Fatalf("expected signed loader URL in %s", index)
+	}
+	if !strings.Contains(index, `var $signatures = {`) || !strings.Contains(index, `"a.01.js":"sig=a"`) {
+		t.Fatalf("expected signatures in %s", index)
+	}
+}
+
+func TestSignedUnsupported(t *testing.T) {
+	ctx := context.Background()
+	d := New(nil, nil, nil, map[bool]string{true: "p", false: "p"}, Config{SigningKey: []byte("key")})
+	if _, err := d.Deploy(ctx, "a", HashIndex, map[bool]bool{true: true}); err == nil {
+		t.Fatal("expected Deploy with HashIndex to fail")
+	}
+	if err := d.Update(ctx, nil, nil, true); err == nil {
+		t.Fatal("expected Update to fail")
+	}
+}
+
+func TestIndexNames(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		aliases  []Alias
+		path     string
+		min      bool
+		expected []string
+	}{
+		// DefaultAliases store the same names as the short paths of the old genIndex
+		{"default", nil, "github.com/a/b", true, []string{"github.com/a/b", "a/b"}},
+		{"default max", nil, "github.com/a/b", false, []string{"github.com/a/b$max", "a/b$max"}},
+		{"default other host", nil, "gitlab.com/a/b", true, []string{"gitlab.com/a/b"}},
+		{"no aliases", []Alias{}, "github.com/a/b", true, []string{"github.com/a/b"}},
+		{
+			"custom",
+			[]Alias{{Prefix: "github.com/", Replace: ""}, {Prefix: "gitlab.com/", Replace: "gl/"}},
+			"gitlab.com/a/b", false,
+			[]string{"gitlab.com/a/b$max", "gl/a/b$max"},
+		},
+		{
+			"duplicates",
+			[]Alias{{Prefix: "go.example.com/", Replace: "example/"}, {Prefix: "go.example.com/a", Replace: "example/a"}},
+			"go.example.com/a", true,
+			[]string{"go.example.com/a", "example/a"},
+		},
+	} {
+		d := New(nil, nil, nil, nil, Config{Aliases: test.aliases})
+		if names := d.indexNames(test.path, test.min); fmt.Sprint(names) != fmt.Sprint(test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, names)
+		}
+	}
+}
+
+func TestIndexDomain(t *testing.T) {
+	ctx := context.Background()
+	d, fs := testDeployer(Config{Domains: map[string]string{"github.com/a/b": "domain"}})
+	storer, _ := d.newStorer(ctx)
+	defer storer.Close()
+	for _, min := range []bool{true, false} {
+		s := &manifestStorer{Storer: storer, build: &ManifestBuild{}}
+		if _, err := d.genIndex(s, indexTemplate, "github.com/a/b", nil, []byte{1}, min, PathIndex); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storer.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"domain": {"$max", "$max/index.html", "index.html"},
+		"index": {
+			"a/b", "a/b$max", "a/b$max/index.html", "a/b/index.html",
+			"github.com/a/b", "github.com/a/b$max", "github.com/a/b$max/index.html", "github.com/a/b/index.html",
+		},
+	}
+	for bucket, names := range expected {
+		objects, err := fs.List(ctx, bucket, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []string
+		for _, o := range objects {
+			found = append(found, o.Name)
+		}
+		sort.Strings(found)
+		if fmt.Sprint(found) != fmt.Sprint(names) {
+			t.Fatalf("expected %v in %s, got %v", names, bucket, found)
+		}
+	}
+}
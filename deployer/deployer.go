@@ -1,8 +1,14 @@
 package deployer
 
 import (
+	"sync"
+	"time"
+
 	"github.com/dave/services"
+	"github.com/dave/services/constor"
 	"github.com/dave/services/session"
+	"github.com/dave/services/signedurl"
+	"github.com/gopherjs/gopherjs/compiler"
 )
 
 type Deployer struct {
@@ -10,7 +16,10 @@ type Deployer struct {
 	send    func(services.Message)
 	config  Config
 	index   map[string]map[bool]string
-	prelude map[bool]string
+
+	// preludes is the hashes of the available preludes: compiler version => minified => hash
+	preludes  map[string]map[bool]string
+	preludesM sync.RWMutex
 }
 
 func New(session *session.Session, send func(services.Message), index map[string]map[bool]string, prelude map[bool]string, config Config) *Deployer {
@@ -19,7 +28,10 @@ func New(session *session.Session, send func(services.Message), index map[string
 	c.send = send
 	c.config = config
 	c.index = index
-	c.prelude = prelude
+	c.preludes = map[string]map[bool]string{}
+	if prelude != nil {
+		c.preludes[compiler.Version] = prelude
+	}
 	return c
 }
 
@@ -29,4 +41,57 @@ type Config struct {
 	PkgBucket                string
 	PkgProtocol              string
 	PkgHost                  string
+	DryRun                   bool // Report the artifacts instead of storing or deleting them
+
+	// SigningKey enables private deployments. The index references the loader with a signed URL, and
+	// passes signed queries for the packages to the loader, so the loader and packages stay immutable.
+	// The signatures expire after SignedUrlExpiry (default 7 days), so private deployments must be
+	// redeployed before then. Everything is stored with private Cache-Control. The index bucket should
+	// also be private and served with URLs from SignedQuery. Private deployments need PathIndex, and
+	// Update (the playground) isn't supported, because its client fetches packages without signatures.
+	SigningKey      []byte
+	SignedUrlExpiry time.Duration
+
+	// Storage configures the storer (compression, retries etc.). If Storage.Workers is zero,
+	// ConcurrentStorageUploads is used.
+	Storage constor.Options
+
+	// PreludeVersion is the compiler version of the prelude used by deploys. If empty, the version of
+	// the compiler this package is built with is used.
+	PreludeVersion string
+
+	// Aliases are the extra names a path index is stored under. If nil, DefaultAliases is used.
+	Aliases []Alias
+
+	// Domains maps deployed paths to the bucket serving a custom domain. The index for the path is
+	// stored at the root of the bucket.
+	Domains map[string]string
+}
+
+// Alias rewrites the start of a deployed path. It's used for short paths (e.g. "github.com/" => ""),
+// other hosts (e.g. "gitlab.com/" => "gl/") and vanity import domains (e.g. "go.example.com/" =>
+// "example/").
+type Alias struct {
+	Prefix  string
+	Replace string
+}
+
+// DefaultAliases stores github.com paths without the github.com/ prefix.
+var DefaultAliases = []Alias{
+	{Prefix: "github.com/", Replace: ""},
+}
+
+// SignedQuery returns the query string that signs a URL for the object name with SigningKey, or an
+// empty string if SigningKey is not set. The expiry is rounded up to the hour so that indexes
+// deployed in the same hour are identical.
+func (d *Deployer) SignedQuery(name string) string {
+	if d.config.SigningKey == nil {
+		return ""
+	}
+	expiry := d.config.SignedUrlExpiry
+	if expiry == 0 {
+		expiry = 7 * 24 * time.Hour
+	}
+	expires := time.Now().Add(expiry).Truncate(time.Hour).Add(time.Hour)
+	return signedurl.Query(d.config.SigningKey, name, expires)
 }
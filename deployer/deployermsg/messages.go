@@ -6,17 +6,26 @@ import (
 
 func RegisterTypes() {
 	gob.Register(ArchiveIndex{})
+	gob.Register(ArchiveOrder{})
 	gob.Register(Archive{})
+	gob.Register(DryRun{})
 }
 
 // ArchiveIndex is a list of dependencies.
 type ArchiveIndex map[string]ArchiveIndexItem
 
+// ArchiveOrder is sent after ArchiveIndex, and tells the client how to load and evict packages.
+type ArchiveOrder struct {
+	Order []string // Order is the import paths of the ArchiveIndex packages in load order (dependencies first).
+	Evict []string // Evict lists the packages in the client cache that are no longer needed.
+}
+
 // ArchiveIndexItem is an item in ArchiveIndex. Unchanged is true if the client already has cached as
 // specified by Cache in the Update message. Unchanged dependencies are not sent as Archive messages.
 type ArchiveIndexItem struct {
-	Hash      string // Hash of the js file
-	Unchanged bool   // Unchanged is true if the package already exists in the client cache.
+	Hash      string   // Hash of the js file
+	Unchanged bool     // Unchanged is true if the package already exists in the client cache.
+	Imports   []string // Imports is the import paths of the package's dependencies.
 }
 
 // Archive contains information about the JS and the stripped GopherJS archive file.
@@ -25,3 +34,39 @@ type Archive struct {
 	Hash     string // Hash of the resultant js
 	Standard bool
 }
+
+// DryRun reports the artifacts a deploy would have stored. It's sent instead of storing anything when
+// the deployer is configured with DryRun.
+type DryRun struct {
+	Artifacts []DryRunArtifact
+}
+
+// DryRunArtifact is an item in DryRun.
+type DryRunArtifact struct {
+	Bucket  string
+	Name    string
+	Size    int
+	Status  DryRunStatus
+	OldHash string // Hash of the existing contents (only set when Status is Overwritten)
+	NewHash string // Hash of the new contents (only set when Status is Overwritten)
+}
+
+type DryRunStatus int
+
+const (
+	New         DryRunStatus = iota // The artifact does not exist and would be stored
+	Unchanged                       // The artifact is immutable and already exists
+	Overwritten                     // The artifact exists and would be overwritten
+)
+
+func (s DryRunStatus) String() string {
+	switch s {
+	case New:
+		return "new"
+	case Unchanged:
+		return "unchanged"
+	case Overwritten:
+		return "overwritten"
+	}
+	return "unknown"
+}
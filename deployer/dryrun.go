@@ -0,0 +1,96 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/dave/services"
+	"github.com/dave/services/constor"
+	"github.com/dave/services/deployer/deployermsg"
+)
+
+// newStorer creates the storer for a deploy. In dry-run mode the storer writes to a recorder instead
+// of the session fileserver, and the recorder is returned so the report can be sent when finished.
+func (d *Deployer) newStorer(ctx context.Context) (*constor.Storer, *recorder) {
+	options := d.config.Storage
+	if options.Workers == 0 {
+		options.Workers = d.config.ConcurrentStorageUploads
+	}
+	if d.config.SigningKey != nil {
+		// private deployments mustn't be cached by shared caches
+		options.Private = true
+	}
+	if !d.config.DryRun {
+		return constor.NewWithOptions(ctx, d.session.Fileserver, d.send, options), nil
+	}
+	// every artifact should be reported, so don't skip known items
+	options.Known = nil
+	r := &recorder{Fileserver: d.session.Fileserver}
+	return constor.NewWithOptions(ctx, r, d.send, options), r
+}
+
+// recorder is a services.Fileserver that records writes instead of performing them. Reads and
+// existence checks are delegated to the wrapped fileserver, so the report reflects what a real deploy
+// would change.
+type recorder struct {
+	services.Fileserver
+	m         sync.Mutex
+	artifacts []deployermsg.DryRunArtifact
+}
+
+func (r *recorder) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return false, err
+	}
+	exists, err := r.Exists(ctx, bucket, name)
+	if err != nil {
+		return false, err
+	}
+	a := deployermsg.DryRunArtifact{
+		Bucket: bucket,
+		Name:   name,
+		Size:   len(b),
+	}
+	switch {
+	case !exists:
+		a.Status = deployermsg.New
+		saved = true
+	case !overwrite:
+		a.Status = deployermsg.Unchanged
+		saved = false
+	default:
+		old := &bytes.Buffer{}
+		if _, err := r.Read(ctx, bucket, name, old); err != nil {
+			return false, err
+		}
+		a.Status = deployermsg.Overwritten
+		a.OldHash = fmt.Sprintf("%x", sha1.Sum(old.Bytes()))
+		a.NewHash = fmt.Sprintf("%x", sha1.Sum(b))
+		saved = true
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.artifacts = append(r.artifacts, a)
+	return saved, nil
+}
+
+// report returns the recorded artifacts sorted by bucket and name.
+func (r *recorder) report() deployermsg.DryRun {
+	r.m.Lock()
+	defer r.m.Unlock()
+	artifacts := append([]deployermsg.DryRunArtifact(nil), r.artifacts...)
+	sort.Slice(artifacts, func(i, j int) bool {
+		if artifacts[i].Bucket != artifacts[j].Bucket {
+			return artifacts[i].Bucket < artifacts[j].Bucket
+		}
+		return artifacts[i].Name < artifacts[j].Name
+	})
+	return deployermsg.DryRun{Artifacts: artifacts}
+}
@@ -0,0 +1,49 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/dave/services/constor"
+	"github.com/dave/services/deployer/deployermsg"
+)
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	d, fs := testDeployer(Config{})
+	store(t, d, d.config.PkgBucket, map[string]string{"a": "a"})
+	store(t, d, d.config.IndexBucket, map[string]string{"x": "old"})
+
+	d.config.DryRun = true
+	storer, recorder := d.newStorer(ctx)
+	defer storer.Close()
+	if recorder == nil {
+		t.Fatal("expected a recorder")
+	}
+	storer.Add(constor.Item{Bucket: d.config.PkgBucket, Name: "a", Contents: []byte("a"), Immutable: true})
+	storer.Add(constor.Item{Bucket: d.config.PkgBucket, Name: "b", Contents: []byte("bb"), Immutable: true})
+	storer.Add(constor.Item{Bucket: d.config.IndexBucket, Name: "x", Contents: []byte("new")})
+	if err := storer.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is written
+	if exists, err := fs.Exists(ctx, d.config.PkgBucket, "b"); err != nil || exists {
+		t.Fatalf("expected b not to be stored, got %v %v", exists, err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := fs.Read(ctx, d.config.IndexBucket, "x", buf); err != nil || buf.String() != "old" {
+		t.Fatalf("expected x not to be overwritten, got %q %v", buf.String(), err)
+	}
+
+	expected := deployermsg.DryRun{Artifacts: []deployermsg.DryRunArtifact{
+		{Bucket: "index", Name: "x", Size: 3, Status: deployermsg.Overwritten, OldHash: hash("old"), NewHash: hash("new")},
+		{Bucket: "pkg", Name: "a", Size: 1, Status: deployermsg.Unchanged},
+		{Bucket: "pkg", Name: "b", Size: 2, Status: deployermsg.New},
+	}}
+	if report := recorder.report(); !reflect.DeepEqual(report, expected) {
+		t.Fatalf("expected %s, got %s", asJson(expected), asJson(report))
+	}
+}
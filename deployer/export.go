@@ -0,0 +1,138 @@
+package deployer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"text/template"
+
+	"github.com/dave/services/builder"
+	"github.com/dave/services/builder/buildermsg"
+	"github.com/dave/services/constor"
+	"github.com/gopherjs/gopherjs/compiler"
+)
+
+// exportPkgDir is the directory in exported sites that holds the loader, prelude and package JS.
+const exportPkgDir = "pkg/"
+
+// Export compiles path and writes a zip of a ready-to-serve static site to w. The zip contains
+// index.html and the minified loader, prelude and package JS in pkg/, referenced with relative URLs.
+// Standard library packages and the prelude are read from the package bucket.
+func (d *Deployer) Export(ctx context.Context, path string, w io.Writer) error {
+
+	const min = true
+
+	if err := d.checkPrelude(min); err != nil {
+		return err
+	}
+
+	d.send(buildermsg.Building{Starting: true})
+
+	data, output, err := d.compile(ctx, path, min)
+	if err != nil {
+		return err
+	}
+
+	d.send(buildermsg.Building{Message: "Export"})
+
+	tpl, err := d.getIndexTpl(data.Dir)
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeExport(ctx, path, tpl, output, w); err != nil {
+		return err
+	}
+
+	d.send(buildermsg.Building{Done: true})
+
+	return nil
+}
+
+// writeExport writes the zip of the exported site of the compiled output to w.
+func (d *Deployer) writeExport(ctx context.Context, path string, tpl *template.Template, output *builder.CommandOutput, w io.Writer) error {
+
+	const min = true
+
+	z := zip.NewWriter(w)
+	add := func(name string, contents []byte) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(contents); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	prelude, err := d.readPrelude(ctx, min)
+	if err != nil {
+		return err
+	}
+	if err := add(fmt.Sprintf("%sprelude.%s.js", exportPkgDir, d.preludeHash(min)), prelude); err != nil {
+		return err
+	}
+
+	for _, po := range output.Packages {
+		name := fmt.Sprintf("%s.%x.js", po.Path, po.Hash)
+		contents := po.Contents
+		if !po.Store {
+			// standard library packages aren't compiled, so are read from the package bucket
+			buf := &bytes.Buffer{}
+			found, err := constor.Read(ctx, d.session.Fileserver, d.config.PkgBucket, name, buf)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("can't export - %s not found in package bucket", name)
+			}
+			contents = buf.Bytes()
+		}
+		if err := add(exportPkgDir+name, contents); err != nil {
+			return err
+		}
+	}
+
+	loader, loaderHash, err := d.renderLoader(output, min, exportPkgDir, false)
+	if err != nil {
+		return err
+	}
+	if err := add(fmt.Sprintf("%s%s.%x.js", exportPkgDir, output.Path, loaderHash), loader); err != nil {
+		return err
+	}
+
+	index, _, err := renderIndex(tpl, path, loaderHash, exportPkgDir, nil)
+	if err != nil {
+		return err
+	}
+	if err := add("index.html", index.Bytes()); err != nil {
+		return err
+	}
+
+	return z.Close()
+}
+
+// readPrelude reads the prelude used by deploys from the package bucket. If it hasn't been stored and
+// it's the prelude of the compiler this package is built with, DefaultPrelude is used.
+func (d *Deployer) readPrelude(ctx context.Context, min bool) ([]byte, error) {
+	hash := d.preludeHash(min)
+	buf := &bytes.Buffer{}
+	found, err := constor.Read(ctx, d.session.Fileserver, d.config.PkgBucket, fmt.Sprintf("prelude.%s.js", hash), buf)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return buf.Bytes(), nil
+	}
+	if d.preludeVersion() == compiler.Version {
+		contents := DefaultPrelude()[min]
+		if fmt.Sprintf("%x", sha1.Sum(contents)) == hash {
+			return contents, nil
+		}
+	}
+	return nil, fmt.Errorf("can't export - prelude.%s.js not found in package bucket", hash)
+}
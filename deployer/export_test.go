@@ -0,0 +1,104 @@
+package deployer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dave/services/builder"
+	"github.com/dave/services/constor"
+)
+
+// testExport exports a command with a compiled package and a standard library package read from the
+// package bucket, and returns the contents of the zip by file name.
+func testExport(t *testing.T, d *Deployer) (output *builder.CommandOutput, files map[string]string) {
+	t.Helper()
+	fmtHash := sha1.Sum([]byte("fmt"))
+	mainHash := sha1.Sum([]byte("main"))
+	output = &builder.CommandOutput{
+		Path: "main",
+		Packages: []*builder.PackageOutput{
+			{Path: "fmt", Hash: fmtHash[:], Standard: true},
+			{Path: "main", Hash: mainHash[:], Contents: []byte("main js"), Store: true},
+		},
+	}
+	store(t, d, d.config.PkgBucket, map[string]string{
+		fmt.Sprintf("prelude.%s.js", hash("prelude")): "prelude js",
+		fmt.Sprintf("fmt.%x.js", fmtHash):             "fmt js",
+	})
+
+	buf := &bytes.Buffer{}
+	if err := d.writeExport(context.Background(), "main", indexTemplate, output, buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+	}
+	return output, files
+}
+
+func TestExport(t *testing.T) {
+	d, _ := testDeployer(Config{})
+	output, files := testExport(t, d)
+
+	loader, loaderHash, err := d.renderLoader(output, true, exportPkgDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaderName := fmt.Sprintf("%smain.%x.js", exportPkgDir, loaderHash)
+
+	expected := map[string]string{
+		fmt.Sprintf("%sprelude.%s.js", exportPkgDir, hash("prelude")): "prelude js",
+		fmt.Sprintf("%sfmt.%s.js", exportPkgDir, hash("fmt")):         "fmt js",
+		fmt.Sprintf("%smain.%s.js", exportPkgDir, hash("main")):       "main js",
+		loaderName: string(loader),
+	}
+	for name, contents := range expected {
+		if files[name] != contents {
+			t.Fatalf("expected %s to be %q, got %q", name, contents, files[name])
+		}
+	}
+	if len(files) != len(expected)+1 {
+		t.Fatalf("expected %d files, got %d", len(expected)+1, len(files))
+	}
+	if !strings.Contains(files["index.html"], fmt.Sprintf(`<script src="%s"></script>`, loaderName)) {
+		t.Fatalf("expected index.html to reference %s, got %q", loaderName, files["index.html"])
+	}
+	if strings.Contains(string(loader), "pkg.host") {
+		t.Fatalf("expected loader to use relative URLs, got %q", loader)
+	}
+}
+
+func TestExportEncoded(t *testing.T) {
+	for _, encoding := range []constor.Encoding{constor.Gzip, constor.Brotli} {
+		d, _ := testDeployer(Config{Storage: constor.Options{Encoding: encoding}})
+		_, files := testExport(t, d)
+		for name, contents := range map[string]string{
+			fmt.Sprintf("%sprelude.%s.js", exportPkgDir, hash("prelude")): "prelude js",
+			fmt.Sprintf("%sfmt.%s.js", exportPkgDir, hash("fmt")):         "fmt js",
+		} {
+			if files[name] != contents {
+				t.Fatalf("%v: expected %s to be %q, got %q", encoding, name, contents, files[name])
+			}
+		}
+	}
+}
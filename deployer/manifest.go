@@ -0,0 +1,101 @@
+package deployer
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dave/services/constor"
+)
+
+// Manifest lists every artifact stored by a deploy. It's stored as JSON in the index bucket as
+// manifest/<path>.<hash>.json, and can be used for auditing, garbage collection and reproducing
+// deploys.
+type Manifest struct {
+	Path   string           `json:"path"`
+	Index  IndexType        `json:"index"`
+	Builds []*ManifestBuild `json:"builds"`
+}
+
+// ManifestBuild is the minified or un-minified variant of a deploy.
+type ManifestBuild struct {
+	Minified  bool                `json:"minified"`
+	Prelude   string              `json:"prelude"` // Hash of the prelude referenced by the loader
+	Version   string              `json:"version"` // Compiler version of the prelude
+	Options   ManifestOptions     `json:"options"`
+	MainHash  string              `json:"main"`
+	IndexHash string              `json:"index"`
+	Artifacts []*ManifestArtifact `json:"artifacts"`
+}
+
+// ManifestOptions are the build options used for a ManifestBuild.
+type ManifestOptions struct {
+	Minify      bool `json:"minify"`
+	Unvendor    bool `json:"unvendor"`
+	Initializer bool `json:"initializer"`
+}
+
+// ManifestArtifact is a single stored object. Path is the package path for package and loader JS, and
+// empty for index files.
+type ManifestArtifact struct {
+	Path   string `json:"path,omitempty"`
+	Hash   string `json:"hash"`
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	Stored bool   `json:"stored"` // False if the immutable artifact already existed
+}
+
+// manifestStorer adds items to the storer, recording each one in the build.
+type manifestStorer struct {
+	*constor.Storer
+	build *ManifestBuild
+}
+
+func (d *Deployer) newManifestBuild(min bool) *ManifestBuild {
+	options := d.defaultOptions(min)
+	return &ManifestBuild{
+		Minified: min,
+		Prelude:  d.preludeHash(min),
+		Version:  d.preludeVersion(),
+		Options: ManifestOptions{
+			Minify:      options.Minify,
+			Unvendor:    options.Unvendor,
+			Initializer: options.Initializer,
+		},
+	}
+}
+
+func (s *manifestStorer) Add(path, hash string, item constor.Item) {
+	a := &ManifestArtifact{
+		Path:   path,
+		Hash:   hash,
+		Bucket: item.Bucket,
+		Name:   item.Name,
+		Size:   len(item.Contents),
+	}
+	s.build.Artifacts = append(s.build.Artifacts, a)
+	item.Result = func(saved bool) {
+		// Result is called before the storer finishes waiting for the item, so there's no need to lock
+		a.Stored = saved
+	}
+	s.Storer.Add(item)
+}
+
+// storeManifest adds the manifest to the storer and returns the name it will be stored under.
+func (d *Deployer) storeManifest(storer *constor.Storer, m *Manifest) (string, error) {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("manifest/%s.%x.json", m.Path, sha1.Sum(b))
+	storer.Add(constor.Item{
+		Message:   "Manifest",
+		Name:      name,
+		Contents:  b,
+		Bucket:    d.config.IndexBucket,
+		Mime:      constor.MimeJson,
+		Immutable: true,
+	})
+	return name, nil
+}
@@ -0,0 +1,75 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/dave/services/constor"
+)
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	d, fs := testDeployer(Config{})
+
+	// a already exists, so it's not stored again
+	store(t, d, d.config.PkgBucket, map[string]string{fmt.Sprintf("a.%s.js", hash("a")): "a"})
+
+	storer, _ := d.newStorer(ctx)
+	defer storer.Close()
+	build := d.newManifestBuild(true)
+	s := &manifestStorer{Storer: storer, build: build}
+	s.Add("a", hash("a"), constor.Item{Bucket: d.config.PkgBucket, Name: fmt.Sprintf("a.%s.js", hash("a")), Contents: []byte("a"), Immutable: true})
+	s.Add("b", hash("bb"), constor.Item{Bucket: d.config.PkgBucket, Name: fmt.Sprintf("b.%s.js", hash("bb")), Contents: []byte("bb"), Immutable: true})
+	s.Add("", hash("index"), constor.Item{Bucket: d.config.IndexBucket, Name: "b", Contents: []byte("index")})
+	if err := storer.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*ManifestArtifact{
+		{Path: "a", Hash: hash("a"), Bucket: "pkg", Name: fmt.Sprintf("a.%s.js", hash("a")), Size: 1, Stored: false},
+		{Path: "b", Hash: hash("bb"), Bucket: "pkg", Name: fmt.Sprintf("b.%s.js", hash("bb")), Size: 2, Stored: true},
+		{Hash: hash("index"), Bucket: "index", Name: "b", Size: 5, Stored: true},
+	}
+	if !reflect.DeepEqual(build.Artifacts, expected) {
+		t.Fatalf("unexpected artifacts: %s", asJson(build.Artifacts))
+	}
+	if build.Prelude != hash("prelude") || !build.Minified || !build.Options.Minify {
+		t.Fatalf("unexpected build: %s", asJson(build))
+	}
+
+	// the manifest is stored as JSON named by its hash
+	manifest := &Manifest{Path: "b", Index: PathIndex, Builds: []*ManifestBuild{build}}
+	storer, _ = d.newStorer(ctx)
+	defer storer.Close()
+	name, err := d.storeManifest(storer, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storer.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if found, err := fs.Read(ctx, d.config.IndexBucket, name, buf); err != nil || !found {
+		t.Fatalf("expected %s to be stored, got %v %v", name, found, err)
+	}
+	if expected := fmt.Sprintf("manifest/b.%x.json", sha1.Sum(buf.Bytes())); name != expected {
+		t.Fatalf("expected %s, got %s", expected, name)
+	}
+	var stored Manifest
+	if err := json.Unmarshal(buf.Bytes(), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&stored, manifest) {
+		t.Fatalf("expected %s, got %s", asJson(manifest), asJson(stored))
+	}
+}
+
+func asJson(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,101 @@
+package deployer
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+
+	"github.com/dave/services/constor"
+	"github.com/gopherjs/gopherjs/compiler"
+	"github.com/gopherjs/gopherjs/compiler/prelude"
+)
+
+// DefaultPrelude returns the minified and un-minified prelude JS of the GopherJS compiler this
+// package is built with. It should be stored under compiler.Version.
+func DefaultPrelude() map[bool][]byte {
+	return map[bool][]byte{
+		true:  []byte(prelude.Minified),
+		false: []byte(prelude.Prelude),
+	}
+}
+
+// AddPrelude registers the hashes of a prelude that is already stored in the package bucket. version
+// is the GopherJS compiler version the prelude was generated by. It's safe to call during deploys.
+func (d *Deployer) AddPrelude(version string, hashes map[bool]string) {
+	d.preludesM.Lock()
+	defer d.preludesM.Unlock()
+	d.preludes[version] = hashes
+}
+
+// StorePrelude stores the minified and un-minified prelude JS in the package bucket as
+// prelude.<hash>.js and registers the hashes under version.
+func (d *Deployer) StorePrelude(ctx context.Context, version string, js map[bool][]byte) (map[bool]string, error) {
+
+	storer, recorder := d.newStorer(ctx)
+	defer storer.Close()
+
+	hashes := map[bool]string{}
+	for min, contents := range js {
+		hashes[min] = fmt.Sprintf("%x", sha1.Sum(contents))
+		storer.Add(constor.Item{
+			Message:   "Prelude",
+			Name:      fmt.Sprintf("prelude.%s.js", hashes[min]),
+			Contents:  contents,
+			Bucket:    d.config.PkgBucket,
+			Mime:      constor.MimeJs,
+			Count:     true,
+			Immutable: true,
+			Send:      true,
+		})
+	}
+
+	if err := storer.Wait(); err != nil {
+		return nil, err
+	}
+
+	if recorder != nil {
+		d.send(recorder.report())
+	}
+
+	d.AddPrelude(version, hashes)
+
+	return hashes, nil
+}
+
+// preludeHashes returns the hashes of all the available preludes.
+func (d *Deployer) preludeHashes() []string {
+	d.preludesM.RLock()
+	defer d.preludesM.RUnlock()
+	var hashes []string
+	for _, m := range d.preludes {
+		for _, hash := range m {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// preludeVersion is the compiler version of the prelude used by deploys.
+func (d *Deployer) preludeVersion() string {
+	if d.config.PreludeVersion != "" {
+		return d.config.PreludeVersion
+	}
+	return compiler.Version
+}
+
+// preludeHash is the hash of the prelude used by deploys. checkPrelude should be called first, because
+// it's empty if the prelude isn't registered.
+func (d *Deployer) preludeHash(min bool) string {
+	d.preludesM.RLock()
+	defer d.preludesM.RUnlock()
+	return d.preludes[d.preludeVersion()][min]
+}
+
+// checkPrelude returns an error if the prelude used by deploys isn't registered, so artifacts never
+// reference a missing prelude.
+func (d *Deployer) checkPrelude(min bool) error {
+	if d.preludeHash(min) == "" {
+		return fmt.Errorf("no prelude registered for compiler version %s", d.preludeVersion())
+	}
+	return nil
+}
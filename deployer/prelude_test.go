@@ -0,0 +1,43 @@
+package deployer
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestUnregisteredPrelude(t *testing.T) {
+	ctx := context.Background()
+	d := New(nil, nil, nil, nil, Config{PreludeVersion: "unregistered"})
+	if _, err := d.Deploy(ctx, "a", HashIndex, map[bool]bool{true: true}); err == nil {
+		t.Fatal("expected Deploy to fail")
+	}
+	if err := d.Update(ctx, nil, nil, true); err == nil {
+		t.Fatal("expected Update to fail")
+	}
+	if err := d.Export(ctx, "a", nil); err == nil {
+		t.Fatal("expected Export to fail")
+	}
+	d.AddPrelude("unregistered", map[bool]string{true: "a", false: "b"})
+	if err := d.checkPrelude(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddPreludeConcurrently(t *testing.T) {
+	d := New(nil, nil, nil, nil, Config{PreludeVersion: "v"})
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		d.AddPrelude("v", map[bool]string{true: "a"})
+	}()
+	go func() {
+		defer wg.Done()
+		d.preludeHash(true)
+	}()
+	wg.Wait()
+	if d.preludeHash(true) != "a" {
+		t.Fatal("expected prelude to be registered")
+	}
+}
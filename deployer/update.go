@@ -3,7 +3,9 @@ package deployer
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"sync/atomic"
 
 	"github.com/dave/services/builder"
@@ -13,9 +15,20 @@ import (
 	"github.com/gopherjs/gopherjs/compiler"
 )
 
+// Update compiles the source for the playground and sends the archives the client needs. The client
+// fetches them from the package bucket without signatures, so private package buckets (SigningKey)
+// aren't supported.
 func (d *Deployer) Update(ctx context.Context, source map[string]map[string]string, cache map[string]string, min bool) error {
 
-	storer := constor.New(ctx, d.session.Fileserver, d.send, d.config.ConcurrentStorageUploads)
+	if d.config.SigningKey != nil {
+		return errors.New("the playground doesn't support private deployments (with SigningKey)")
+	}
+
+	if err := d.checkPrelude(min); err != nil {
+		return err
+	}
+
+	storer, recorder := d.newStorer(ctx)
 	defer storer.Close()
 
 	d.send(buildermsg.Building{Starting: true})
@@ -65,6 +78,7 @@ func (d *Deployer) Update(ctx context.Context, source map[string]map[string]stri
 		index[archive.ImportPath] = deployermsg.ArchiveIndexItem{
 			Hash:      hash,
 			Unchanged: unchanged,
+			Imports:   archive.Imports,
 		}
 
 		if unchanged {
@@ -120,11 +134,11 @@ func (d *Deployer) Update(ctx context.Context, source map[string]map[string]stri
 		return nil
 	}
 
-	if cachedPrelude, exists := cache["prelude"]; !exists || cachedPrelude != d.prelude[min] {
+	if cachedPrelude, exists := cache["prelude"]; !exists || cachedPrelude != d.preludeHash(min) {
 		// send the prelude first if it's not in the cache
 		d.send(deployermsg.Archive{
 			Path:     "prelude",
-			Hash:     d.prelude[min],
+			Hash:     d.preludeHash(min),
 			Standard: true,
 		})
 	}
@@ -144,13 +158,71 @@ func (d *Deployer) Update(ctx context.Context, source map[string]map[string]stri
 		return err
 	}
 
+	if recorder != nil {
+		d.send(recorder.report())
+	}
+
 	d.send(index)
+	d.send(deployermsg.ArchiveOrder{
+		Order: loadOrder(index),
+		Evict: evictions(index, cache),
+	})
 
 	d.send(buildermsg.Building{Done: true})
 
 	return nil
 }
 
+// loadOrder sorts the packages topologically so each package comes after its dependencies. Imports
+// that aren't in packages (e.g. packages in the source collection) are ignored.
+func loadOrder(packages deployermsg.ArchiveIndex) []string {
+	var paths []string
+	for path := range packages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var order []string
+	visited := map[string]bool{}
+	var visit func(path string)
+	visit = func(path string) {
+		if visited[path] {
+			return
+		}
+		visited[path] = true
+		item, ok := packages[path]
+		if !ok {
+			return
+		}
+		imports := append([]string(nil), item.Imports...)
+		sort.Strings(imports)
+		for _, imp := range imports {
+			visit(imp)
+		}
+		order = append(order, path)
+	}
+	for _, path := range paths {
+		visit(path)
+	}
+	return order
+}
+
+// evictions returns the sorted paths of the packages in the client cache that aren't in packages. The
+// prelude is never evicted.
+func evictions(packages deployermsg.ArchiveIndex, cache map[string]string) []string {
+	var evict []string
+	for path := range cache {
+		if path == "prelude" {
+			continue
+		}
+		if _, ok := packages[path]; !ok {
+			evict = append(evict, path)
+		}
+	}
+	sort.Strings(evict)
+	return evict
+}
+
 func StripArchive(a *compiler.Archive) *compiler.Archive {
 	out := &compiler.Archive{
 		ImportPath: a.ImportPath,
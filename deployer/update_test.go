@@ -0,0 +1,58 @@
+package deployer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dave/services/deployer/deployermsg"
+)
+
+func TestLoadOrder(t *testing.T) {
+	packages := deployermsg.ArchiveIndex{
+		"main/b":  {Imports: []string{"fmt", "main/a"}},
+		"main/a":  {Imports: []string{"fmt", "source/c"}},
+		"fmt":     {Imports: []string{"runtime"}},
+		"runtime": {},
+	}
+	order := loadOrder(packages)
+	if len(order) != len(packages) {
+		t.Fatalf("expected %d packages, got %v", len(packages), order)
+	}
+	position := map[string]int{}
+	for i, path := range order {
+		position[path] = i
+	}
+	for path, item := range packages {
+		for _, imp := range item.Imports {
+			if _, ok := packages[imp]; !ok {
+				continue
+			}
+			if position[imp] > position[path] {
+				t.Fatalf("expected %s before %s, got %v", imp, path, order)
+			}
+		}
+	}
+	// sorted, so the order is stable
+	if fmt.Sprint(order) != "[runtime fmt main/a main/b]" {
+		t.Fatalf("unexpected order %v", order)
+	}
+}
+
+func TestEvictions(t *testing.T) {
+	packages := deployermsg.ArchiveIndex{
+		"fmt":     {},
+		"runtime": {},
+	}
+	cache := map[string]string{
+		"prelude": "a",
+		"fmt":     "b",
+		"strings": "c",
+		"errors":  "d",
+	}
+	if evict := evictions(packages, cache); fmt.Sprint(evict) != "[errors strings]" {
+		t.Fatalf("expected [errors strings], got %v", evict)
+	}
+	if evict := evictions(packages, nil); len(evict) != 0 {
+		t.Fatalf("expected nothing evicted, got %v", evict)
+	}
+}
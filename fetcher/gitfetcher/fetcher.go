@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dave/services"
@@ -31,12 +32,18 @@ func New(cache, fileserver services.Fileserver, config Config) *Fetcher {
 		cache:      cache,
 		fileserver: fileserver,
 		config:     config,
+		etags:      map[string]string{},
 	}
 }
 
 type Fetcher struct {
 	cache, fileserver services.Fileserver
 	config            Config
+
+	// etags holds the ETag of the fileserver archive that the cached archive was copied from or to,
+	// by repo url.
+	m     sync.Mutex
+	etags map[string]string
 }
 
 type Config struct {
@@ -53,18 +60,11 @@ func (f *Fetcher) Fetch(ctx context.Context, url string) (billy.Filesystem, erro
 		return nil, err
 	}
 
-	exists, err := f.load(ctx, f.cache, url, persisted)
+	exists, err := f.load(ctx, url, persisted)
 	if err != nil {
 		return nil, err
 	}
 
-	if !exists {
-		exists, err = f.load(ctx, f.fileserver, url, persisted)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	var changed bool
 
 	if exists {
@@ -92,7 +92,15 @@ func (f *Fetcher) Fetch(ctx context.Context, url string) (billy.Filesystem, erro
 	// we don't want the context to be cancelled half way through saving, so let's create a new one:
 	gitctx, _ := context.WithTimeout(context.Background(), f.config.GitSaveTimeout)
 	if changed {
-		go f.save(gitctx, f.fileserver, url, persisted)
+		go func() {
+			if err := f.save(gitctx, f.fileserver, url, persisted); err != nil {
+				return
+			}
+			// the cached archive will match the new fileserver archive
+			if attrs, found, err := f.fileserver.Stat(gitctx, f.config.GitBucket, escape(url)); err == nil && found {
+				f.setETag(url, attrs.ETag)
+			}
+		}()
 	}
 	go f.save(gitctx, f.cache, url, persisted)
 
@@ -287,6 +295,22 @@ func matchProgress(s string) (matched bool, objects int) {
 	return false, 0
 }
 
+func escape(repoUrl string) string {
+	return url.PathEscape(repoUrl)
+}
+
+func (f *Fetcher) etag(repoUrl string) string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.etags[repoUrl]
+}
+
+func (f *Fetcher) setETag(repoUrl, etag string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.etags[repoUrl] = etag
+}
+
 func (f *Fetcher) save(ctx context.Context, fileserver services.Fileserver, repoUrl string, fs billy.Filesystem) error {
 	// open the persisted git file for reading
 	persisted, err := fs.Open(FNAME)
@@ -294,18 +318,66 @@ func (f *Fetcher) save(ctx context.Context, fileserver services.Fileserver, repo
 		return err
 	}
 	defer persisted.Close()
-	if _, err := fileserver.Write(ctx, f.config.GitBucket, url.PathEscape(repoUrl), persisted, true, "application/octet-stream", "no-cache"); err != nil {
+	if _, err := fileserver.Write(ctx, f.config.GitBucket, escape(repoUrl), persisted, true, "application/octet-stream", "no-cache", ""); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (f *Fetcher) load(ctx context.Context, fileserver services.Fileserver, repoUrl string, fs billy.Filesystem) (found bool, err error) {
-	// open / create the persisted git file for writing
+// load copies the repo archive to fs. The cached archive is used if the fileserver archive hasn't
+// changed since it was cached (e.g. by another server), so unchanged archives aren't downloaded. If
+// the ETag of the cached archive isn't known, the cached archive is used without checking.
+func (f *Fetcher) load(ctx context.Context, repoUrl string, fs billy.Filesystem) (found bool, err error) {
+	cached, err := f.copy(ctx, f.cache, repoUrl, fs, services.ReadOptions{})
+	if err != nil {
+		return false, err
+	}
+	etag := f.etag(repoUrl)
+	if cached && etag == "" {
+		return true, nil
+	}
+	options := services.ReadOptions{}
+	if cached {
+		options.IfNoneMatch = etag
+	}
+	found, err = f.copy(ctx, f.fileserver, repoUrl, fs, options)
+	if err != nil {
+		return false, err
+	}
+	if !found && !cached {
+		// create an empty persisted git file for the clone
+		persisted, err := fs.Create(FNAME)
+		if err != nil {
+			return false, err
+		}
+		persisted.Close()
+	}
+	return found || cached, nil
+}
+
+// copy streams the repo archive from fileserver to fs. If the archive matches options.IfNoneMatch, fs
+// isn't changed.
+func (f *Fetcher) copy(ctx context.Context, fileserver services.Fileserver, repoUrl string, fs billy.Filesystem, options services.ReadOptions) (found bool, err error) {
+	reader, attrs, found, err := fileserver.Open(ctx, f.config.GitBucket, escape(repoUrl), options)
+	if err != nil || !found {
+		return false, err
+	}
+	if reader == nil {
+		// not modified
+		return true, nil
+	}
+	defer reader.Close()
+	// create (or truncate) the persisted git file for writing
 	persisted, err := fs.Create(FNAME)
 	if err != nil {
 		return false, err
 	}
 	defer persisted.Close()
-	return fileserver.Read(ctx, f.config.GitBucket, url.PathEscape(repoUrl), persisted)
+	if _, err := io.Copy(persisted, reader); err != nil {
+		return false, err
+	}
+	if fileserver == f.fileserver {
+		f.setETag(repoUrl, attrs.ETag)
+	}
+	return true, nil
 }
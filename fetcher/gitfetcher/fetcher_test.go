@@ -0,0 +1,104 @@
+package gitfetcher
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dave/services"
+	"github.com/dave/services/fileserver/cachefileserver"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+)
+
+// counting is a services.Fileserver that counts the archives transferred by Open.
+type counting struct {
+	services.Fileserver
+	m      sync.Mutex
+	copies int
+}
+
+func (c *counting) Open(ctx context.Context, bucket, name string, options services.ReadOptions) (reader io.ReadCloser, attrs services.Attrs, found bool, err error) {
+	reader, attrs, found, err = c.Fileserver.Open(ctx, bucket, name, options)
+	if reader != nil {
+		c.m.Lock()
+		c.copies++
+		c.m.Unlock()
+	}
+	return reader, attrs, found, err
+}
+
+func (c *counting) count() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.copies
+}
+
+func persisted(t *testing.T, fs billy.Filesystem) string {
+	t.Helper()
+	file, err := fs.Open(FNAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	const url = "https://github.com/a/b"
+	cache := cachefileserver.New(1<<20, 1<<20)
+	fileserver := &counting{Fileserver: cachefileserver.New(1<<20, 1<<20)}
+	f := New(cache, fileserver, Config{GitBucket: "git"})
+	write := func(fs services.Fileserver, contents string) {
+		if _, err := fs.Write(ctx, "git", escape(url), strings.NewReader(contents), true, "application/octet-stream", "no-cache", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a new repo has an empty archive
+	fs := memfs.New()
+	if found, err := f.load(ctx, url, fs); err != nil || found {
+		t.Fatalf("expected not found, got %v %v", found, err)
+	}
+	if contents := persisted(t, fs); contents != "" {
+		t.Fatalf("expected empty archive, got %q", contents)
+	}
+
+	// the fileserver archive is copied and its ETag recorded
+	write(fileserver.Fileserver, "a")
+	fs = memfs.New()
+	if found, err := f.load(ctx, url, fs); err != nil || !found {
+		t.Fatalf("expected found, got %v %v", found, err)
+	}
+	if contents := persisted(t, fs); contents != "a" || fileserver.count() != 1 || f.etag(url) == "" {
+		t.Fatalf("expected archive a to be copied, got %q, %d copies, etag %q", contents, fileserver.count(), f.etag(url))
+	}
+
+	// an unchanged ETag skips the copy from the fileserver
+	write(cache, "a")
+	fs = memfs.New()
+	if found, err := f.load(ctx, url, fs); err != nil || !found {
+		t.Fatalf("expected found, got %v %v", found, err)
+	}
+	if contents := persisted(t, fs); contents != "a" || fileserver.count() != 1 {
+		t.Fatalf("expected cached archive a without a copy, got %q, %d copies", contents, fileserver.count())
+	}
+
+	// a changed fileserver archive (e.g. saved by another server) replaces the cached archive
+	write(fileserver.Fileserver, "b")
+	fs = memfs.New()
+	if found, err := f.load(ctx, url, fs); err != nil || !found {
+		t.Fatalf("expected found, got %v %v", found, err)
+	}
+	if contents := persisted(t, fs); contents != "b" || fileserver.count() != 2 {
+		t.Fatalf("expected archive b to be copied, got %q, %d copies", contents, fileserver.count())
+	}
+}
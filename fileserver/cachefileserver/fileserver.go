@@ -3,51 +3,95 @@ package cachefileserver
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/dave/services"
 )
 
 func New(maxTotal, maxItem uint64) *Fileserver {
 	return &Fileserver{
 		maxTotal: maxTotal,
 		maxItem:  maxItem,
+		keys:     map[string]*item{},
+		ids:      map[uint64]*item{},
+		ttl:      map[string]time.Duration{},
 	}
 }
 
 type Fileserver struct {
-	maxTotal uint64           // the maximum size in bytes
-	maxItem  uint64           // the maximum size of a single item in bytes
-	keys     map[string]*item // items ordered by key
-	ids      map[uint64]*item // items ordered by id
-	total    uint64           // the current total size in bytes
-	oldest   uint64           // the next id to be evicted
-	newest   uint64           // the next id to be added
+	maxTotal uint64                   // the maximum size in bytes
+	maxItem  uint64                   // the maximum size of a single item in bytes
+	keys     map[string]*item         // items ordered by key
+	ids      map[uint64]*item         // items ordered by id
+	ttl      map[string]time.Duration // expiry time for items by bucket
+	total    uint64                   // the current total size in bytes
+	oldest   uint64                   // the next id to be evicted
+	newest   uint64                   // the next id to be added
+	stats    Stats
 	m        sync.Mutex
 }
 
+// Stats are the counters of a Fileserver.
+type Stats struct {
+	Hits         uint64 // Reads of cached items
+	Misses       uint64 // Reads of items not in the cache (or expired)
+	Evictions    uint64 // Items removed to make space
+	Expirations  uint64 // Items removed because their TTL has passed
+	Items        uint64 // Number of items currently cached
+	Bytes        uint64 // Total size of the items currently cached
+	MaxBytes     uint64 // Maximum total size
+	BytesRead    uint64 // Bytes returned by reads
+	BytesWritten uint64 // Bytes saved by writes
+}
+
 type item struct {
-	key  string
-	id   uint64
-	data []byte
+	key     string
+	bucket  string
+	name    string
+	id      uint64
+	data    []byte
+	attrs   services.Attrs
+	expires time.Time // zero if the item doesn't expire
+}
+
+// SetTTL sets the time items in bucket remain in the cache after they are written. Zero disables
+// expiry. Items already in the cache keep their expiry time until they are overwritten.
+func (f *Fileserver) SetTTL(bucket string, ttl time.Duration) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.ttl[bucket] = ttl
+}
+
+// Stats returns a snapshot of the counters.
+func (f *Fileserver) Stats() Stats {
+	f.m.Lock()
+	defer f.m.Unlock()
+	s := f.stats
+	s.Items = uint64(len(f.keys))
+	s.Bytes = f.total
+	s.MaxBytes = f.maxTotal
+	return s
 }
 
 func (f *Fileserver) Exists(ctx context.Context, bucket, name string) (bool, error) {
-	panic("exists not implemented for cachefileserver")
+	f.m.Lock()
+	defer f.m.Unlock()
+	_, ok := f.get(filepath.Join(bucket, name))
+	return ok, nil
 }
 
-func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl string) (saved bool, err error) {
+func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
 
 	key := filepath.Join(bucket, name)
 
-	if f.keys == nil {
-		f.keys = map[string]*item{}
-	}
-	if f.ids == nil {
-		f.ids = map[uint64]*item{}
-	}
-
 	b, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return false, err
@@ -55,7 +99,7 @@ func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.R
 
 	var length = uint64(len(b))
 
-	if length > f.maxItem {
+	if length > f.maxItem || length > f.maxTotal {
 		// double check the actual size of the bytes
 		return false, nil
 	}
@@ -63,45 +107,74 @@ func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.R
 	f.m.Lock()
 	defer f.m.Unlock()
 
-	f.newest++
-	newid := f.newest
-
-	if i, ok := f.keys[key]; ok {
-		// if the item already exist, update the id so it's not evicted
-
-		// total after updating this item will be total + new length - old length.
-		for f.total+length-uint64(len(i.data)) > f.maxTotal {
-			f.evictOldest()
+	if i, ok := f.get(key); ok {
+		if !overwrite {
+			return false, nil
 		}
+		// remove the old item, so the total is correct while evicting and the new item gets a new
+		// id so it's not evicted
+		f.remove(i)
+	}
 
-		delete(f.ids, i.id)
-		i.id = newid
-		i.data = b
-		f.ids[newid] = i
+	// total after adding the item is total + length
+	for f.total+length > f.maxTotal {
+		f.evictOldest()
+	}
 
-	} else {
+	f.newest++
+	now := time.Now()
+	i := &item{key: key, bucket: bucket, name: name, id: f.newest, data: b}
+	i.attrs = services.Attrs{
+		Size:            int64(length),
+		ContentType:     contentType,
+		CacheControl:    cacheControl,
+		ContentEncoding: contentEncoding,
+		ETag:            fmt.Sprintf("%x", sha1.Sum(b)),
+		Updated:         now,
+	}
+	if ttl := f.ttl[bucket]; ttl > 0 {
+		i.expires = now.Add(ttl)
+	}
+	f.keys[key] = i
+	f.ids[i.id] = i
+	f.total += length
+	f.stats.BytesWritten += length
 
-		// total after adding a new item is total + length
-		for f.total+length > f.maxTotal {
-			f.evictOldest()
-		}
+	return true, nil
+}
 
-		i := &item{key: key, id: newid, data: b}
-		f.keys[key] = i
-		f.ids[newid] = i
-		f.total += length
+// get returns the item with key, removing it if it has expired. This should only run when the mutex
+// is locked.
+func (f *Fileserver) get(key string) (*item, bool) {
+	i, ok := f.keys[key]
+	if !ok {
+		return nil, false
+	}
+	if f.expired(i) {
+		f.remove(i)
+		f.stats.Expirations++
+		return nil, false
 	}
+	return i, true
+}
 
-	return true, nil
+func (f *Fileserver) expired(i *item) bool {
+	return !i.expires.IsZero() && time.Now().After(i.expires)
 }
 
 // this should only run when the mutex is locked
+func (f *Fileserver) remove(i *item) {
+	f.total -= uint64(len(i.data))
+	delete(f.ids, i.id)
+	delete(f.keys, i.key)
+}
+
+// this should only run when the mutex is locked, and there must be at least one item in the cache
 func (f *Fileserver) evictOldest() {
 	for {
 		if i, ok := f.ids[f.oldest]; ok {
-			f.total -= uint64(len(i.data))
-			delete(f.ids, f.oldest)
-			delete(f.keys, i.key)
+			f.remove(i)
+			f.stats.Evictions++
 			f.oldest++
 			break
 		}
@@ -112,19 +185,108 @@ func (f *Fileserver) evictOldest() {
 func (f *Fileserver) Read(ctx context.Context, bucket, name string, writer io.Writer) (found bool, err error) {
 	f.m.Lock()
 	defer f.m.Unlock()
-	key := filepath.Join(bucket, name)
-	i, ok := f.keys[key]
+	i, ok := f.get(filepath.Join(bucket, name))
 	if !ok {
+		f.stats.Misses++
 		return false, nil
 	}
-	// if the item already exist, update the id so it's not evicted
+	f.hit(i, uint64(len(i.data)))
+	if _, err := io.Copy(writer, bytes.NewBuffer(i.data)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hit records a read of n bytes of i, and updates the id so it's not evicted. This should only run
+// when the mutex is locked.
+func (f *Fileserver) hit(i *item, n uint64) {
+	f.stats.Hits++
+	f.stats.BytesRead += n
 	f.newest++
 	newid := f.newest
 	delete(f.ids, i.id)
 	i.id = newid
 	f.ids[newid] = i
-	if _, err := io.Copy(writer, bytes.NewBuffer(i.data)); err != nil {
-		return false, err
+}
+
+func (f *Fileserver) Stat(ctx context.Context, bucket, name string) (attrs services.Attrs, found bool, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	i, ok := f.get(filepath.Join(bucket, name))
+	if !ok {
+		return services.Attrs{}, false, nil
+	}
+	return i.attrs, true, nil
+}
+
+// Open returns a reader of the cached data. Items are replaced rather than modified when written, so
+// the data can be read after the mutex is unlocked.
+func (f *Fileserver) Open(ctx context.Context, bucket, name string, options services.ReadOptions) (reader io.ReadCloser, attrs services.Attrs, found bool, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	i, ok := f.get(filepath.Join(bucket, name))
+	if !ok {
+		f.stats.Misses++
+		return nil, services.Attrs{}, false, nil
+	}
+	if options.IfNoneMatch != "" && options.IfNoneMatch == i.attrs.ETag {
+		f.hit(i, 0)
+		return nil, i.attrs, true, nil
+	}
+	data := i.data
+	if options.Offset > int64(len(data)) {
+		data = nil
+	} else {
+		data = data[options.Offset:]
+	}
+	if options.Length > 0 && options.Length < int64(len(data)) {
+		data = data[:options.Length]
+	}
+	f.hit(i, uint64(len(data)))
+	return ioutil.NopCloser(bytes.NewReader(data)), i.attrs, true, nil
+}
+
+func (f *Fileserver) List(ctx context.Context, bucket, prefix string) ([]services.Object, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	var objects []services.Object
+	for _, i := range f.keys {
+		if i.bucket != bucket || !strings.HasPrefix(i.name, prefix) {
+			continue
+		}
+		if f.expired(i) {
+			f.remove(i)
+			f.stats.Expirations++
+			continue
+		}
+		objects = append(objects, services.Object{
+			Name:    i.name,
+			Size:    int64(len(i.data)),
+			Updated: i.attrs.Updated,
+		})
+	}
+	sort.Slice(objects, func(a, b int) bool { return objects[a].Name < objects[b].Name })
+	return objects, nil
+}
+
+func (f *Fileserver) Delete(ctx context.Context, bucket, name string) (found bool, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	i, ok := f.get(filepath.Join(bucket, name))
+	if !ok {
+		return false, nil
 	}
+	f.remove(i)
 	return true, nil
 }
+
+// ListPage lists a page of the objects returned by List (see services.Page). Every page lists all the
+// objects with the prefix, so it's O(n) per page.
+func (f *Fileserver) ListPage(ctx context.Context, bucket string, options services.ListOptions) (objects []services.Object, next string, err error) {
+	all, err := f.List(ctx, bucket, options.Prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	objects, next = services.Page(all, options)
+	return objects, next, nil
+}
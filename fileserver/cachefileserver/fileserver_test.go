@@ -0,0 +1,104 @@
+package cachefileserver
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dave/services"
+	"github.com/dave/services/fileserver/fileservertest"
+)
+
+func TestOverwrite(t *testing.T) {
+	ctx := context.Background()
+	f := New(100, 100)
+	write(t, f, "a", "1", false, true)
+	write(t, f, "a", "22", false, false)
+	if s := read(t, f, "a"); s != "1" {
+		t.Fatalf("expected 1, got %q", s)
+	}
+	write(t, f, "a", "22", true, true)
+	if s := read(t, f, "a"); s != "22" {
+		t.Fatalf("expected 22, got %q", s)
+	}
+	if exists, _ := f.Exists(ctx, "bucket", "a"); !exists {
+		t.Fatal("expected a to exist")
+	}
+	if stats := f.Stats(); stats.Bytes != 2 || stats.Items != 1 || stats.Hits != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	f := New(4, 4)
+	write(t, f, "a", "11", true, true)
+	write(t, f, "b", "22", true, true)
+	read(t, f, "a") // b is now the oldest
+	write(t, f, "c", "33", true, true)
+	if s := read(t, f, "b"); s != "" {
+		t.Fatal("expected b to be evicted")
+	}
+	if stats := f.Stats(); stats.Evictions != 1 || stats.Misses != 1 || stats.Bytes != 4 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	f := New(100, 100)
+	f.SetTTL("bucket", time.Millisecond)
+	write(t, f, "a", "1", true, true)
+	time.Sleep(5 * time.Millisecond)
+	if exists, _ := f.Exists(ctx, "bucket", "a"); exists {
+		t.Fatal("expected a to expire")
+	}
+	if stats := f.Stats(); stats.Expirations != 1 || stats.Bytes != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func write(t *testing.T, f *Fileserver, name, contents string, overwrite, expected bool) {
+	t.Helper()
+	saved, err := f.Write(context.Background(), "bucket", name, strings.NewReader(contents), overwrite, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != expected {
+		t.Fatalf("writing %s: expected saved=%v", name, expected)
+	}
+}
+
+func read(t *testing.T, f *Fileserver, name string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if _, err := f.Read(context.Background(), "bucket", name, buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	f := New(100, 100)
+	write(t, f, "a", "12345", true, true)
+	reader, attrs, found, err := f.Open(ctx, "bucket", "a", services.ReadOptions{Offset: 1, Length: 3})
+	if err != nil || !found {
+		t.Fatalf("expected found, got %v %v", found, err)
+	}
+	b, _ := ioutil.ReadAll(reader)
+	if string(b) != "234" || attrs.Size != 5 {
+		t.Fatalf("unexpected range read: %q %+v", b, attrs)
+	}
+	if reader, _, _, _ := f.Open(ctx, "bucket", "a", services.ReadOptions{IfNoneMatch: attrs.ETag}); reader != nil {
+		t.Fatal("expected not modified")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	fileservertest.Run(t, func(t *testing.T) (services.Fileserver, func()) {
+		return New(1<<24, 1<<24), nil
+	})
+}
@@ -0,0 +1,475 @@
+// package fileservertest is a conformance test suite for services.Fileserver implementations.
+package fileservertest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dave/services"
+)
+
+// Bucket is the bucket used by the tests. The fileserver must be able to store to it.
+const Bucket = "bucket"
+
+// Run runs the conformance tests. New is called at the start of each test, and must return a
+// fileserver with an empty Bucket, and a function to release its resources when the test finishes
+// (or nil).
+func Run(t *testing.T, New func(t *testing.T) (fs services.Fileserver, close func())) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, fs services.Fileserver)
+	}{
+		{"WriteRead", testWriteRead},
+		{"Overwrite", testOverwrite},
+		{"Missing", testMissing},
+		{"Names", testNames},
+		{"Large", testLarge},
+		{"Stat", testStat},
+		{"Open", testOpen},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"ConcurrentReaders", testConcurrentReaders},
+		{"FailedWrite", testFailedWrite},
+		{"Cancelled", testCancelled},
+		{"List", testList},
+		{"ListPage", testListPage},
+		{"Delete", testDelete},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, close := New(t)
+			if close != nil {
+				defer close()
+			}
+			test.test(t, fs)
+		})
+	}
+}
+
+func testWriteRead(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	mustWrite(t, fs, "a", "contents", true)
+	if exists, err := fs.Exists(ctx, Bucket, "a"); err != nil || !exists {
+		t.Fatalf("Exists: expected true, got %v %v", exists, err)
+	}
+	if s := mustRead(t, fs, "a"); s != "contents" {
+		t.Fatalf("Read: expected contents, got %q", s)
+	}
+}
+
+func testOverwrite(t *testing.T, fs services.Fileserver) {
+	if !mustWrite(t, fs, "a", "1", false) {
+		t.Fatal("Write: expected new object to be saved")
+	}
+	if mustWrite(t, fs, "a", "2", false) {
+		t.Fatal("Write: expected existing object not to be saved without overwrite")
+	}
+	if s := mustRead(t, fs, "a"); s != "1" {
+		t.Fatalf("Read: expected 1, got %q", s)
+	}
+	if !mustWrite(t, fs, "a", "3", true) {
+		t.Fatal("Write: expected existing object to be saved with overwrite")
+	}
+	if s := mustRead(t, fs, "a"); s != "3" {
+		t.Fatalf("Read: expected 3, got %q", s)
+	}
+}
+
+func testMissing(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	buf := &bytes.Buffer{}
+	if found, err := fs.Read(ctx, Bucket, "missing", buf); err != nil || found || buf.Len() > 0 {
+		t.Fatalf("Read: expected not found, got %v %v %q", found, err, buf.String())
+	}
+	if exists, err := fs.Exists(ctx, Bucket, "missing"); err != nil || exists {
+		t.Fatalf("Exists: expected false, got %v %v", exists, err)
+	}
+	if _, found, err := fs.Stat(ctx, Bucket, "missing"); err != nil || found {
+		t.Fatalf("Stat: expected not found, got %v %v", found, err)
+	}
+	if reader, _, found, err := fs.Open(ctx, Bucket, "missing", services.ReadOptions{}); err != nil || found || reader != nil {
+		t.Fatalf("Open: expected not found, got %v %v", found, err)
+	}
+	if found, err := fs.Delete(ctx, Bucket, "missing"); err != nil || found {
+		t.Fatalf("Delete: expected not found, got %v %v", found, err)
+	}
+	if objects, err := fs.List(ctx, Bucket, ""); err != nil || len(objects) != 0 {
+		t.Fatalf("List: expected no objects, got %v %v", objects, err)
+	}
+}
+
+// names that need escaping in paths, URLs or file names
+var awkwardNames = []string{
+	"a/b/c.js",
+	"a/b/index.html",
+	"dir/",
+	"üñíçødé/日本語 ✓.js",
+	"space and symbols ?#%&+=;@.js",
+	"..",
+}
+
+func testNames(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	for _, name := range awkwardNames {
+		mustWrite(t, fs, name, name, true)
+	}
+	for _, name := range awkwardNames {
+		if s := mustRead(t, fs, name); s != name {
+			t.Fatalf("Read %s: got %q", name, s)
+		}
+	}
+	objects, err := fs.List(ctx, Bucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(awkwardNames) {
+		t.Fatalf("List: expected %d objects, got %s", len(awkwardNames), objectNames(objects))
+	}
+	objects, err = fs.List(ctx, Bucket, "üñíçødé/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Name != "üñíçødé/日本語 ✓.js" {
+		t.Fatalf("List: expected üñíçødé/日本語 ✓.js, got %s", objectNames(objects))
+	}
+}
+
+func testLarge(t *testing.T, fs services.Fileserver) {
+	contents := large()
+	mustWrite(t, fs, "large", contents, true)
+	if s := mustRead(t, fs, "large"); s != contents {
+		t.Fatalf("Read: contents differ (%d bytes, expected %d)", len(s), len(contents))
+	}
+}
+
+// large returns 5 MB of contents that don't repeat in short cycles.
+func large() string {
+	b := make([]byte, 5<<20)
+	rand.New(rand.NewSource(1)).Read(b)
+	return string(b)
+}
+
+func testStat(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	mustWrite(t, fs, "a", "contents", true)
+	attrs, found, err := fs.Stat(ctx, Bucket, "a")
+	if err != nil || !found {
+		t.Fatalf("Stat: expected found, got %v %v", found, err)
+	}
+	if attrs.Size != 8 || attrs.ContentType != "text/plain" || attrs.CacheControl != "no-cache" || attrs.ETag == "" {
+		t.Fatalf("Stat: unexpected attrs %+v", attrs)
+	}
+	mustWrite(t, fs, "a", "changed", true)
+	changed, _, err := fs.Stat(ctx, Bucket, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.ETag == attrs.ETag {
+		t.Fatal("Stat: expected ETag to change")
+	}
+}
+
+func testOpen(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	mustWrite(t, fs, "a", "0123456789", true)
+	for _, test := range []struct {
+		options  services.ReadOptions
+		expected string
+	}{
+		{services.ReadOptions{}, "0123456789"},
+		{services.ReadOptions{Offset: 3}, "3456789"},
+		{services.ReadOptions{Offset: 3, Length: 2}, "34"},
+		{services.ReadOptions{Length: 20}, "0123456789"},
+	} {
+		reader, attrs, found, err := fs.Open(ctx, Bucket, "a", test.options)
+		if err != nil || !found || reader == nil {
+			t.Fatalf("Open %+v: expected found, got %v %v", test.options, found, err)
+		}
+		b, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.expected || attrs.Size != 10 {
+			t.Fatalf("Open %+v: expected %q, got %q (size %d)", test.options, test.expected, b, attrs.Size)
+		}
+	}
+	attrs, _, err := fs.Stat(ctx, Bucket, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, _, found, err := fs.Open(ctx, Bucket, "a", services.ReadOptions{IfNoneMatch: attrs.ETag})
+	if err != nil || !found || reader != nil {
+		t.Fatalf("Open: expected not modified, got %v %v %v", reader != nil, found, err)
+	}
+	reader, _, found, err = fs.Open(ctx, Bucket, "a", services.ReadOptions{IfNoneMatch: "other"})
+	if err != nil || !found || reader == nil {
+		t.Fatalf("Open: expected modified, got %v %v %v", reader != nil, found, err)
+	}
+	reader.Close()
+}
+
+// testConcurrentWriters checks that exactly one of several concurrent writes without overwrite is
+// saved.
+func testConcurrentWriters(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	const writers = 10
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	var saved []string
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			contents := fmt.Sprint(i)
+			ok, err := fs.Write(ctx, Bucket, "a", strings.NewReader(contents), false, "", "", "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				m.Lock()
+				saved = append(saved, contents)
+				m.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(saved) != 1 {
+		t.Fatalf("Write: expected exactly one write to be saved, got %v", saved)
+	}
+	if s := mustRead(t, fs, "a"); s != saved[0] {
+		t.Fatalf("Read: expected %s, got %q", saved[0], s)
+	}
+}
+
+// testConcurrentReaders checks that readers never see partial contents while the object is being
+// overwritten.
+func testConcurrentReaders(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	const size = 1 << 18
+	contents := func(i int) string {
+		return strings.Repeat(fmt.Sprint(i), size)
+	}
+	mustWrite(t, fs, "a", contents(0), true)
+	var wg sync.WaitGroup
+	for i := 1; i < 5; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := fs.Write(ctx, Bucket, "a", strings.NewReader(contents(i)), true, "", "", ""); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			buf := &bytes.Buffer{}
+			if _, err := fs.Read(ctx, Bucket, "a", buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if s := buf.String(); len(s) != size || strings.Count(s, s[:1]) != size {
+				t.Errorf("Read: got partial or mixed contents (%d bytes)", len(s))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// testFailedWrite checks that nothing is stored if the reader fails part way through.
+func testFailedWrite(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	reader := io.MultiReader(strings.NewReader(large()), failing{})
+	if _, err := fs.Write(ctx, Bucket, "a", reader, true, "", "", ""); err == nil {
+		t.Fatal("Write: expected error")
+	}
+	if exists, err := fs.Exists(ctx, Bucket, "a"); err != nil || exists {
+		t.Fatalf("Exists: expected false after failed write, got %v %v", exists, err)
+	}
+}
+
+type failing struct{}
+
+func (failing) Read([]byte) (int, error) {
+	return 0, errors.New("failing reader")
+}
+
+// testCancelled checks that a write with a cancelled context either fails or stores the full
+// contents, and that a read with a cancelled context either fails or reads the full contents.
+func testCancelled(t *testing.T, fs services.Fileserver) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	contents := large()
+	if _, err := fs.Write(ctx, Bucket, "a", strings.NewReader(contents), true, "", "", ""); err == nil {
+		if s := mustRead(t, fs, "a"); s != contents {
+			t.Fatalf("Read: partial contents after cancelled write (%d bytes)", len(s))
+		}
+	} else if exists, err := fs.Exists(context.Background(), Bucket, "a"); err != nil || exists {
+		t.Fatalf("Exists: expected false after failed write, got %v %v", exists, err)
+	}
+	mustWrite(t, fs, "b", contents, true)
+	buf := &bytes.Buffer{}
+	if found, err := fs.Read(ctx, Bucket, "b", buf); err == nil && (!found || buf.String() != contents) {
+		t.Fatalf("Read: partial contents without error (%d bytes)", buf.Len())
+	}
+}
+
+func testList(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	for _, name := range []string{"b/2", "a", "b/1", "c"} {
+		mustWrite(t, fs, name, name, true)
+	}
+	objects, err := fs.List(ctx, Bucket, "b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := objectNames(objects); names != "b/1 b/2" {
+		t.Fatalf("List: expected b/1 b/2, got %s", names)
+	}
+	if objects[0].Size != 3 {
+		t.Fatalf("List: expected size 3, got %d", objects[0].Size)
+	}
+	if objects, err := fs.List(ctx, Bucket, "d"); err != nil || len(objects) != 0 {
+		t.Fatalf("List: expected no objects, got %v %v", objects, err)
+	}
+}
+
+func testListPage(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		mustWrite(t, fs, fmt.Sprintf("p/%d", i), "x", true)
+	}
+	mustWrite(t, fs, "q", "x", true)
+	var all []services.Object
+	var pages int
+	options := services.ListOptions{Prefix: "p/", PageSize: 2}
+	for {
+		objects, next, err := fs.ListPage(ctx, Bucket, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) > 2 {
+			t.Fatalf("ListPage: expected at most 2 objects, got %d", len(objects))
+		}
+		all = append(all, objects...)
+		pages++
+		if next == "" {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("ListPage: too many pages")
+		}
+		options.PageToken = next
+	}
+	if names := objectNames(all); names != "p/0 p/1 p/2 p/3 p/4" {
+		t.Fatalf("ListPage: expected p/0 to p/4, got %s", names)
+	}
+}
+
+func testDelete(t *testing.T, fs services.Fileserver) {
+	ctx := context.Background()
+	mustWrite(t, fs, "a", "contents", true)
+	if found, err := fs.Delete(ctx, Bucket, "a"); err != nil || !found {
+		t.Fatalf("Delete: expected found, got %v %v", found, err)
+	}
+	if found, err := fs.Delete(ctx, Bucket, "a"); err != nil || found {
+		t.Fatalf("Delete: expected not found, got %v %v", found, err)
+	}
+	if exists, err := fs.Exists(ctx, Bucket, "a"); err != nil || exists {
+		t.Fatalf("Exists: expected false after Delete, got %v %v", exists, err)
+	}
+	if objects, err := fs.List(ctx, Bucket, ""); err != nil || len(objects) != 0 {
+		t.Fatalf("List: expected no objects after Delete, got %v %v", objects, err)
+	}
+}
+
+func mustWrite(t *testing.T, fs services.Fileserver, name, contents string, overwrite bool) bool {
+	t.Helper()
+	saved, err := fs.Write(context.Background(), Bucket, name, strings.NewReader(contents), overwrite, "text/plain", "no-cache", "")
+	if err != nil {
+		t.Fatalf("Write %s: %v", name, err)
+	}
+	return saved
+}
+
+// mustRead returns the contents, failing the test if the object is not found.
+func mustRead(t *testing.T, fs services.Fileserver, name string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	found, err := fs.Read(context.Background(), Bucket, name, buf)
+	if err != nil {
+		t.Fatalf("Read %s: %v", name, err)
+	}
+	if !found {
+		t.Fatalf("Read %s: not found", name)
+	}
+	return buf.String()
+}
+
+func objectNames(objects []services.Object) string {
+	var names []string
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+// Prefixed returns a fileserver that stores the objects of every bucket in bucket under prefix. It can
+// be used to run the tests against a shared bucket of a storage service.
+func Prefixed(fs services.Fileserver, bucket, prefix string) services.Fileserver {
+	return &prefixed{fs: fs, bucket: bucket, prefix: prefix}
+}
+
+type prefixed struct {
+	fs             services.Fileserver
+	bucket, prefix string
+}
+
+func (p *prefixed) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	return p.fs.Write(ctx, p.bucket, p.prefix+name, reader, overwrite, contentType, cacheControl, contentEncoding)
+}
+
+func (p *prefixed) Read(ctx context.Context, bucket, name string, writer io.Writer) (found bool, err error) {
+	return p.fs.Read(ctx, p.bucket, p.prefix+name, writer)
+}
+
+func (p *prefixed) Exists(ctx context.Context, bucket, name string) (bool, error) {
+	return p.fs.Exists(ctx, p.bucket, p.prefix+name)
+}
+
+func (p *prefixed) List(ctx context.Context, bucket, prefix string) ([]services.Object, error) {
+	objects, err := p.fs.List(ctx, p.bucket, p.prefix+prefix)
+	return p.trim(objects), err
+}
+
+func (p *prefixed) ListPage(ctx context.Context, bucket string, options services.ListOptions) (objects []services.Object, next string, err error) {
+	options.Prefix = p.prefix + options.Prefix
+	objects, next, err = p.fs.ListPage(ctx, p.bucket, options)
+	return p.trim(objects), next, err
+}
+
+func (p *prefixed) trim(objects []services.Object) []services.Object {
+	for i := range objects {
+		objects[i].Name = strings.TrimPrefix(objects[i].Name, p.prefix)
+	}
+	return objects
+}
+
+func (p *prefixed) Delete(ctx context.Context, bucket, name string) (found bool, err error) {
+	return p.fs.Delete(ctx, p.bucket, p.prefix+name)
+}
+
+func (p *prefixed) Stat(ctx context.Context, bucket, name string) (attrs services.Attrs, found bool, err error) {
+	return p.fs.Stat(ctx, p.bucket, p.prefix+name)
+}
+
+func (p *prefixed) Open(ctx context.Context, bucket, name string, options services.ReadOptions) (reader io.ReadCloser, attrs services.Attrs, found bool, err error) {
+	return p.fs.Open(ctx, p.bucket, p.prefix+name, options)
+}
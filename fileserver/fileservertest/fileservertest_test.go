@@ -0,0 +1,14 @@
+package fileservertest
+
+import (
+	"testing"
+
+	"github.com/dave/services"
+	"github.com/dave/services/fileserver/cachefileserver"
+)
+
+func TestPrefixed(t *testing.T) {
+	Run(t, func(t *testing.T) (services.Fileserver, func()) {
+		return Prefixed(cachefileserver.New(1<<24, 1<<24), "other", "prefix/"), nil
+	})
+}
@@ -3,8 +3,13 @@ package gcsfileserver
 import (
 	"context"
 	"io"
+	"net/http"
+	"strconv"
 
 	"cloud.google.com/go/storage"
+	"github.com/dave/services"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 )
 
 func New(client *storage.Client, buckets []string) *Fileserver {
@@ -17,6 +22,18 @@ func New(client *storage.Client, buckets []string) *Fileserver {
 	return f
 }
 
+// IsTransient reports whether err is a GCS error that should be retried: rate limiting, server errors
+// and network timeouts. It can be used as constor.Options.Transient.
+func IsTransient(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code == http.StatusTooManyRequests || e.Code >= http.StatusInternalServerError
+	}
+	if e, ok := err.(interface{ Temporary() bool }); ok && e.Temporary() {
+		return true
+	}
+	return false
+}
+
 type Fileserver struct {
 	client  *storage.Client
 	buckets map[string]*storage.BucketHandle
@@ -40,9 +57,12 @@ func (f *Fileserver) exists(ctx context.Context, ob *storage.ObjectHandle) (bool
 	return false, err
 }
 
-func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl string) (saved bool, err error) {
+// Write without overwrite uses the DoesNotExist precondition, so only one of several concurrent writers
+// succeeds.
+func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
 	ob := f.buckets[bucket].Object(name)
 	if !overwrite {
+		// avoid uploading the contents if the object exists
 		exists, err := f.exists(ctx, ob)
 		if err != nil {
 			return false, err
@@ -50,19 +70,34 @@ func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.R
 		if exists {
 			return false, nil
 		}
+		ob = ob.If(storage.Conditions{DoesNotExist: true})
 	}
+	// cancelling the context before Close aborts the upload, so partial contents aren't stored
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	wc := ob.NewWriter(ctx)
-	defer wc.Close()
 	wc.ContentType = contentType
 	wc.CacheControl = cacheControl
+	wc.ContentEncoding = contentEncoding
 	if _, err := io.Copy(wc, reader); err != nil {
+		cancel()
+		wc.Close()
+		return false, err
+	}
+	if err := wc.Close(); err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed && !overwrite {
+			// created by another writer since the exists check
+			return false, nil
+		}
 		return false, err
 	}
 	return true, nil
 }
 
+// Read reads the stored bytes. Objects stored with Content-Encoding gzip aren't decompressed, like
+// the other fileservers.
 func (f *Fileserver) Read(ctx context.Context, bucket, name string, writer io.Writer) (found bool, err error) {
-	ob := f.buckets[bucket].Object(name)
+	ob := f.buckets[bucket].Object(name).ReadCompressed(true)
 	r, err := ob.NewReader(ctx)
 	if err != nil {
 		if err == storage.ErrObjectNotExist {
@@ -75,3 +110,109 @@ func (f *Fileserver) Read(ctx context.Context, bucket, name string, writer io.Wr
 	}
 	return true, nil
 }
+
+func (f *Fileserver) List(ctx context.Context, bucket, prefix string) ([]services.Object, error) {
+	var objects []services.Object
+	it := f.buckets[bucket].Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, services.Object{
+			Name:    attrs.Name,
+			Size:    attrs.Size,
+			Updated: attrs.Updated,
+		})
+	}
+	return objects, nil
+}
+
+func (f *Fileserver) Delete(ctx context.Context, bucket, name string) (found bool, err error) {
+	if err := f.buckets[bucket].Object(name).Delete(ctx); err != nil {
+		if err == storage.ErrObjectNotExist {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Stat returns the object attributes. The ETag is the generation.
+func (f *Fileserver) Stat(ctx context.Context, bucket, name string) (attrs services.Attrs, found bool, err error) {
+	a, err := f.buckets[bucket].Object(name).Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return services.Attrs{}, false, nil
+		}
+		return services.Attrs{}, false, err
+	}
+	return attrsOf(a), true, nil
+}
+
+func attrsOf(a *storage.ObjectAttrs) services.Attrs {
+	return services.Attrs{
+		Size:            a.Size,
+		ContentType:     a.ContentType,
+		CacheControl:    a.CacheControl,
+		ContentEncoding: a.ContentEncoding,
+		ETag:            strconv.FormatInt(a.Generation, 10),
+		Updated:         a.Updated,
+	}
+}
+
+// Open reads the attributes first, then reads the contents of that generation so the attributes match
+// the contents. If the generation is replaced in between, it tries again.
+func (f *Fileserver) Open(ctx context.Context, bucket, name string, options services.ReadOptions) (reader io.ReadCloser, attrs services.Attrs, found bool, err error) {
+	ob := f.buckets[bucket].Object(name)
+	length := options.Length
+	if length == 0 {
+		length = -1
+	}
+	for attempt := 0; ; attempt++ {
+		a, err := ob.Attrs(ctx)
+		if err != nil {
+			if err == storage.ErrObjectNotExist {
+				return nil, services.Attrs{}, false, nil
+			}
+			return nil, services.Attrs{}, false, err
+		}
+		attrs = attrsOf(a)
+		if options.IfNoneMatch != "" && options.IfNoneMatch == attrs.ETag {
+			return nil, attrs, true, nil
+		}
+		// the stored bytes are read, so they match attrs.ContentEncoding
+		r, err := ob.Generation(a.Generation).ReadCompressed(true).NewRangeReader(ctx, options.Offset, length)
+		if err == storage.ErrObjectNotExist && attempt < 2 {
+			continue
+		}
+		if err != nil {
+			return nil, services.Attrs{}, false, err
+		}
+		return r, attrs, true, nil
+	}
+}
+
+func (f *Fileserver) ListPage(ctx context.Context, bucket string, options services.ListOptions) (objects []services.Object, next string, err error) {
+	size := options.PageSize
+	if size == 0 {
+		size = services.DefaultPageSize
+	}
+	it := f.buckets[bucket].Objects(ctx, &storage.Query{Prefix: options.Prefix})
+	var attrs []*storage.ObjectAttrs
+	next, err = iterator.NewPager(it, size, options.PageToken).NextPage(&attrs)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, a := range attrs {
+		objects = append(objects, services.Object{
+			Name:    a.Name,
+			Size:    a.Size,
+			Updated: a.Updated,
+		})
+	}
+	return objects, next, nil
+}
@@ -0,0 +1,41 @@
+package gcsfileserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/dave/services"
+	"github.com/dave/services/fileserver/fileservertest"
+)
+
+// TestConformance runs against the bucket in GCS_TEST_BUCKET, using the default credentials.
+func TestConformance(t *testing.T) {
+	bucket := os.Getenv("GCS_TEST_BUCKET")
+	if bucket == "" {
+		t.Skip("GCS_TEST_BUCKET not set")
+	}
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fs := New(client, []string{bucket})
+	fileservertest.Run(t, func(t *testing.T) (services.Fileserver, func()) {
+		prefix := fmt.Sprintf("fileservertest/%d/", time.Now().UnixNano())
+		return fileservertest.Prefixed(fs, bucket, prefix), func() {
+			objects, err := fs.List(ctx, bucket, prefix)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, o := range objects {
+				fs.Delete(ctx, bucket, o.Name)
+			}
+		}
+	})
+}
@@ -1,49 +1,187 @@
 package localfileserver
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/dave/services"
 	"github.com/mitchellh/go-homedir"
 )
 
+// New creates a Fileserver storing files in dir, and starts an HTTP server for each site, serving
+// bucket[site] on host[site]. Errors from the servers are sent to Errors, and Shutdown stops them.
 func New(dir string, sites []string, host, bucket map[string]string) *Fileserver {
+	return NewWithKeys(dir, sites, host, bucket, nil)
+}
+
+// NewWithKeys is New with private sites. Requests to a site with a key must have a query string signed
+// with the key (see signedurl), or are rejected with 403 Forbidden.
+func NewWithKeys(dir string, sites []string, host, bucket map[string]string, keys map[string][]byte) *Fileserver {
 	expanded, err := homedir.Expand(dir)
 	if err != nil {
 		panic(err)
 	}
+	f := &Fileserver{
+		dir:    expanded,
+		errors: make(chan error, len(sites)),
+	}
 	for _, site := range sites {
-		go http.ListenAndServe(host[site], pathEscape(http.FileServer(http.Dir(filepath.Join(expanded, bucket[site])))))
+		h := f.Handler(bucket[site])
+		if key := keys[site]; key != nil {
+			h = verify(key, h)
+		}
+		server := &http.Server{Addr: host[site], Handler: h}
+		f.servers = append(f.servers, server)
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				f.errors <- err
+			}
+		}()
 	}
-	return &Fileserver{
-		dir: expanded,
+	return f
+}
+
+type Fileserver struct {
+	dir     string
+	servers []*http.Server
+	errors  chan error
+}
+
+// Errors receives the errors of the HTTP servers started by New, e.g. if the address is in use.
+func (f *Fileserver) Errors() <-chan error {
+	return f.errors
+}
+
+// Shutdown gracefully shuts down the HTTP servers started by New (see http.Server.Shutdown).
+func (f *Fileserver) Shutdown(ctx context.Context) error {
+	var first error
+	for _, server := range f.servers {
+		if err := server.Shutdown(ctx); err != nil && first == nil {
+			first = err
+		}
 	}
+	return first
 }
 
-func pathEscape(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r2 := new(http.Request)
-		*r2 = *r
-		r2.URL = new(url.URL)
-		*r2.URL = *r.URL
-		r2.URL.Path = "/" + url.PathEscape(strings.TrimPrefix(r.URL.Path, "/"))
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		h.ServeHTTP(w, r2)
-	})
+// meta is the metadata of a file, stored in a sidecar file in the .meta directory (bucket names can't
+// start with a dot, so it's never served).
+type meta struct {
+	ContentType     string `json:",omitempty"`
+	CacheControl    string `json:",omitempty"`
+	ContentEncoding string `json:",omitempty"`
 }
 
-type Fileserver struct {
-	dir string
+func (f *Fileserver) metaPath(bucket, name string) string {
+	return filepath.Join(f.dir, ".meta", bucket, escape(name)+".json")
+}
+
+// readMeta returns the metadata of a file, or empty metadata if it was written without a sidecar.
+func (f *Fileserver) readMeta(bucket, name string) (meta, error) {
+	var m meta
+	b, err := ioutil.ReadFile(f.metaPath(bucket, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// writeMeta writes the sidecar, or removes it if the metadata is empty.
+func (f *Fileserver) writeMeta(bucket, name string, m meta) error {
+	if m == (meta{}) {
+		return f.removeMeta(bucket, name)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = writeAtomic(f.metaPath(bucket, name), bytes.NewReader(b), true)
+	return err
+}
+
+func (f *Fileserver) removeMeta(bucket, name string) error {
+	if err := os.Remove(f.metaPath(bucket, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// tempPattern is the pattern of temporary files. They are created in the destination directory so
+// they can be renamed, and they're not valid escaped names, so List skips them.
+const tempPattern = "%tmp*"
+
+// writeAtomic writes the contents of reader to a temporary file, then moves it to fpath so readers
+// never see partial contents. If overwrite is false and fpath exists, it's not changed and saved is
+// false. This is enforced with a hard link, which fails if fpath exists.
+func writeAtomic(fpath string, reader io.Reader, overwrite bool) (saved bool, err error) {
+	dir := filepath.Dir(fpath)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return false, err
+	}
+	file, err := ioutil.TempFile(dir, tempPattern)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name()) // no-op after a successful rename
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return false, err
+	}
+	// temporary files are created with 0600
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Close(); err != nil {
+		return false, err
+	}
+	if overwrite {
+		if err := os.Rename(file.Name(), fpath); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := os.Link(file.Name(), fpath); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// path returns the file path of an object. Each object is a file in the bucket directory.
+func (f *Fileserver) path(bucket, name string) string {
+	return filepath.Join(f.dir, bucket, escape(name))
+}
+
+// escape converts an object name to a file name. The dot segments "." and ".." are the only names
+// that aren't changed by url.PathEscape but aren't valid file names.
+func escape(name string) string {
+	escaped := url.PathEscape(name)
+	if escaped == "." || escaped == ".." {
+		return strings.Replace(escaped, ".", "%2E", -1)
+	}
+	return escaped
 }
 
 func (f *Fileserver) Exists(ctx context.Context, bucket, name string) (bool, error) {
-	return f.exists(ctx, filepath.Join(f.dir, bucket, url.PathEscape(name)))
+	return f.exists(ctx, f.path(bucket, name))
 }
 
 func (f *Fileserver) exists(ctx context.Context, fpath string) (bool, error) {
@@ -60,10 +198,10 @@ func (f *Fileserver) exists(ctx context.Context, fpath string) (bool, error) {
 	return false, err
 }
 
-func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl string) (saved bool, err error) {
-	fdir := filepath.Join(f.dir, bucket)
-	fpath := filepath.Join(f.dir, bucket, url.PathEscape(name))
+func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	fpath := f.path(bucket, name)
 	if !overwrite {
+		// avoid copying the contents if the file exists. writeAtomic checks again atomically.
 		exists, err := f.exists(ctx, fpath)
 		if err != nil {
 			return false, err
@@ -72,23 +210,36 @@ func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.R
 			return false, nil
 		}
 	}
-	if err := os.MkdirAll(fdir, 0777); err != nil {
+	// The metadata is published before the contents, so readers never see new contents with missing or
+	// stale metadata, and the contents aren't published if the metadata can't be written. Writers of
+	// the same name should use the same metadata when overwrite is false, because a writer that loses
+	// the race to create the file has already replaced the metadata. If the contents can't be written,
+	// the previous metadata is restored.
+	previous, err := ioutil.ReadFile(f.metaPath(bucket, name))
+	if err != nil && !os.IsNotExist(err) {
 		return false, err
 	}
-	fmt.Println("creating", fpath)
-	file, err := os.Create(fpath)
-	if err != nil {
+	if err := f.writeMeta(bucket, name, meta{ContentType: contentType, CacheControl: cacheControl, ContentEncoding: contentEncoding}); err != nil {
 		return false, err
 	}
-	defer file.Close()
-	if _, err := io.Copy(file, reader); err != nil {
+	saved, err = writeAtomic(fpath, reader, overwrite)
+	if err != nil {
+		if previous == nil {
+			f.removeMeta(bucket, name)
+		} else {
+			writeAtomic(f.metaPath(bucket, name), bytes.NewReader(previous), true)
+		}
 		return false, err
 	}
+	if !saved {
+		// !saved => another writer created the file since the exists check
+		return false, nil
+	}
 	return true, nil
 }
 
 func (f *Fileserver) Read(ctx context.Context, bucket, name string, writer io.Writer) (found bool, err error) {
-	fpath := filepath.Join(f.dir, bucket, url.PathEscape(name))
+	fpath := f.path(bucket, name)
 	file, err := os.Open(fpath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -102,3 +253,125 @@ func (f *Fileserver) Read(ctx context.Context, bucket, name string, writer io.Wr
 	}
 	return true, nil
 }
+
+func (f *Fileserver) List(ctx context.Context, bucket, prefix string) ([]services.Object, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(f.dir, bucket))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var objects []services.Object
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(info.Name())
+		if err != nil {
+			// not written by Write, so skip
+			continue
+		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		objects = append(objects, services.Object{
+			Name:    name,
+			Size:    info.Size(),
+			Updated: info.ModTime(),
+		})
+	}
+	// ReadDir sorts by escaped name
+	sort.Slice(objects, func(a, b int) bool { return objects[a].Name < objects[b].Name })
+	return objects, nil
+}
+
+func (f *Fileserver) Delete(ctx context.Context, bucket, name string) (found bool, err error) {
+	fpath := f.path(bucket, name)
+	if err := os.Remove(fpath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := f.removeMeta(bucket, name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Stat returns the metadata written with the file. The ETag is derived from the size and modification
+// time.
+func (f *Fileserver) Stat(ctx context.Context, bucket, name string) (attrs services.Attrs, found bool, err error) {
+	info, err := os.Stat(f.path(bucket, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return services.Attrs{}, false, nil
+		}
+		return services.Attrs{}, false, err
+	}
+	return f.attrsOf(bucket, name, info)
+}
+
+func (f *Fileserver) attrsOf(bucket, name string, info os.FileInfo) (services.Attrs, bool, error) {
+	m, err := f.readMeta(bucket, name)
+	if err != nil {
+		return services.Attrs{}, false, err
+	}
+	return services.Attrs{
+		Size:            info.Size(),
+		ContentType:     m.ContentType,
+		CacheControl:    m.CacheControl,
+		ContentEncoding: m.ContentEncoding,
+		ETag:            fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+		Updated:         info.ModTime(),
+	}, true, nil
+}
+
+func (f *Fileserver) Open(ctx context.Context, bucket, name string, options services.ReadOptions) (reader io.ReadCloser, attrs services.Attrs, found bool, err error) {
+	file, err := os.Open(f.path(bucket, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, services.Attrs{}, false, nil
+		}
+		return nil, services.Attrs{}, false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, services.Attrs{}, false, err
+	}
+	attrs, _, err = f.attrsOf(bucket, name, info)
+	if err != nil {
+		file.Close()
+		return nil, services.Attrs{}, false, err
+	}
+	if options.IfNoneMatch != "" && options.IfNoneMatch == attrs.ETag {
+		file.Close()
+		return nil, attrs, true, nil
+	}
+	if _, err := file.Seek(options.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, services.Attrs{}, false, err
+	}
+	if options.Length > 0 {
+		return readCloser{io.LimitReader(file, options.Length), file}, attrs, true, nil
+	}
+	return file, attrs, true, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ListPage lists a page of the objects returned by List (see services.Page). Every page lists all the
+// objects with the prefix, so it's O(n) per page.
+func (f *Fileserver) ListPage(ctx context.Context, bucket string, options services.ListOptions) (objects []services.Object, next string, err error) {
+	all, err := f.List(ctx, bucket, options.Prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	objects, next = services.Page(all, options)
+	return objects, next, nil
+}
@@ -0,0 +1,187 @@
+package localfileserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dave/services"
+	"github.com/dave/services/fileserver/fileservertest"
+)
+
+func TestConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "localfileserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := New(dir, nil, nil, nil)
+
+	contents := func(i int) string {
+		return strings.Repeat(fmt.Sprint(i%10), 100000)
+	}
+
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	var saved int
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := f.Write(ctx, "bucket", "immutable", strings.NewReader(contents(i)), false, "", "", "")
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				m.Lock()
+				saved++
+				m.Unlock()
+			}
+			if _, err := f.Write(ctx, "bucket", "mutable", strings.NewReader(contents(i)), true, "", "", ""); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			buf := &bytes.Buffer{}
+			found, err := f.Read(ctx, "bucket", "mutable", buf)
+			if err != nil {
+				t.Error(err)
+			}
+			if found && buf.Len() != 100000 {
+				t.Errorf("read partial file: %d bytes", buf.Len())
+			}
+		}()
+	}
+	wg.Wait()
+	if saved != 1 {
+		t.Fatalf("expected one write of immutable to be saved, got %d", saved)
+	}
+	objects, err := f.List(ctx, "bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("expected no temporary files, got %v", objects)
+	}
+}
+
+func TestMetaBeforeContents(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "localfileserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := New(dir, nil, nil, nil)
+
+	// a reader never finds the file without its metadata
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := f.Write(ctx, "bucket", "a", strings.NewReader("a"), false, "text/plain", "", "gzip"); err != nil {
+			t.Error(err)
+		}
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		attrs, found, err := f.Stat(ctx, "bucket", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found && attrs.ContentEncoding != "gzip" {
+			t.Fatalf("found a without its metadata: %+v", attrs)
+		}
+	}
+
+	// the contents aren't published if the metadata can't be written
+	if err := ioutil.WriteFile(filepath.Join(dir, ".meta", "broken"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(ctx, "broken", "b", strings.NewReader("b"), false, "text/plain", "", ""); err == nil {
+		t.Fatal("expected error")
+	}
+	if exists, err := f.Exists(ctx, "broken", "b"); err != nil || exists {
+		t.Fatalf("expected b not to exist, got %v %v", exists, err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("failed")
+}
+
+func TestWriteFailureRestoresMeta(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "localfileserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := New(dir, nil, nil, nil)
+
+	// the previous sidecar is restored
+	if _, err := f.Write(ctx, "bucket", "a", strings.NewReader("a"), true, "text/plain", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(ctx, "bucket", "a", failingReader{}, true, "text/html", "", "gzip"); err == nil {
+		t.Fatal("expected error")
+	}
+	attrs, found, err := f.Stat(ctx, "bucket", "a")
+	if err != nil || !found || attrs.ContentType != "text/plain" || attrs.ContentEncoding != "" {
+		t.Fatalf("expected the previous metadata, got %+v %v %v", attrs, found, err)
+	}
+
+	// a new sidecar is removed
+	if _, err := f.Write(ctx, "bucket", "b", failingReader{}, false, "text/html", "", "gzip"); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(f.metaPath("bucket", "b")); !os.IsNotExist(err) {
+		t.Fatalf("expected no sidecar, got %v", err)
+	}
+}
+
+func TestDeleteMeta(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "localfileserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := New(dir, nil, nil, nil)
+	if _, err := f.Write(ctx, "bucket", "a", strings.NewReader("a"), true, "text/plain", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.metaPath("bucket", "a")); err != nil {
+		t.Fatalf("expected sidecar: %v", err)
+	}
+	if found, err := f.Delete(ctx, "bucket", "a"); err != nil || !found {
+		t.Fatalf("expected a to be deleted, got %v %v", found, err)
+	}
+	if _, err := os.Stat(f.metaPath("bucket", "a")); !os.IsNotExist(err) {
+		t.Fatalf("expected sidecar to be removed, got %v", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	fileservertest.Run(t, func(t *testing.T) (services.Fileserver, func()) {
+		dir, err := ioutil.TempDir("", "localfileserver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return New(dir, nil, nil, nil), func() { os.RemoveAll(dir) }
+	})
+}
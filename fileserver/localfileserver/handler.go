@@ -0,0 +1,122 @@
+package localfileserver
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dave/services/signedurl"
+)
+
+// Handler serves the files in bucket with the metadata they were written with. Request paths are the
+// unescaped file names. A precompressed variant is served if the client accepts its encoding, and
+// conditional and range requests are supported (see http.ServeContent).
+func (f *Fileserver) Handler(bucket string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		attrs, found, err := f.Stat(r.Context(), bucket, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		fname := name
+		if attrs.ContentEncoding == "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+			for _, e := range encodings {
+				if !accepted[e.name] {
+					continue
+				}
+				variant, found, err := f.Stat(r.Context(), bucket, name+e.ext)
+				if err != nil || !found {
+					continue
+				}
+				fname = name + e.ext
+				attrs.ContentEncoding = e.name
+				attrs.ETag = variant.ETag
+				attrs.Updated = variant.Updated
+				break
+			}
+		}
+		file, err := os.Open(f.path(bucket, fname))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// deleted since Stat
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		if attrs.ContentType != "" {
+			w.Header().Set("Content-Type", attrs.ContentType)
+		}
+		if attrs.CacheControl != "" {
+			w.Header().Set("Cache-Control", attrs.CacheControl)
+		}
+		if attrs.ContentEncoding != "" {
+			w.Header().Set("Content-Encoding", attrs.ContentEncoding)
+		}
+		w.Header().Set("ETag", strconv.Quote(attrs.ETag))
+		// the content type is guessed from the name if it wasn't written with the file
+		http.ServeContent(w, r, name, attrs.Updated, file)
+	})
+}
+
+// verify rejects requests without a valid signature for the requested object. The signed name is the
+// unescaped object name.
+func verify(key []byte, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if err := signedurl.Verify(key, name, r.URL.Query(), time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// encodings are the precompressed variants served by Handler, in order of preference. The variants
+// are stored alongside the file with the suffix (see constor.Options).
+var encodings = []struct{ name, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptedEncodings parses an Accept-Encoding header, ignoring encodings with q=0.
+func acceptedEncodings(header string) map[string]bool {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		accepted[name] = q > 0
+	}
+	return accepted
+}
@@ -0,0 +1,70 @@
+package localfileserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "localfileserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := New(dir, nil, nil, nil)
+	if _, err := f.Write(ctx, "bucket", "a/b.js", strings.NewReader("0123456789"), true, "application/javascript", "max-age=60", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(ctx, "bucket", "a/b.js.gz", strings.NewReader("compressed"), true, "application/javascript", "max-age=60", "gzip"); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(f.Handler("bucket"))
+	defer server.Close()
+
+	get := func(header ...string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+"/a/b.js", nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	body := func(resp *http.Response) string {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	resp := get()
+	if resp.Header.Get("Content-Type") != "application/javascript" || resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("unexpected headers: %v", resp.Header)
+	}
+	etag := resp.Header.Get("ETag")
+	if b := body(resp); b != "0123456789" || etag == "" {
+		t.Fatalf("unexpected response: %q %q", b, etag)
+	}
+
+	if resp := get("If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected not modified, got %d", resp.StatusCode)
+	}
+
+	resp = get("Range", "bytes=2-4")
+	if b := body(resp); resp.StatusCode != http.StatusPartialContent || b != "234" {
+		t.Fatalf("unexpected range response: %d %q", resp.StatusCode, b)
+	}
+
+	resp = get("Accept-Encoding", "gzip")
+	if b := body(resp); resp.Header.Get("Content-Encoding") != "gzip" || b != "compressed" {
+		t.Fatalf("unexpected encoded response: %q %v", b, resp.Header)
+	}
+}
@@ -0,0 +1,350 @@
+// package s3fileserver is a services.Fileserver for S3 compatible object storage, using the REST API
+// with signature version 4 authentication.
+package s3fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dave/services"
+)
+
+// Config configures the connection to the storage service.
+type Config struct {
+	Endpoint     string // Base URL of the service, e.g. https://s3.us-east-1.amazonaws.com
+	Region       string // e.g. us-east-1
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // Optional, for temporary credentials
+}
+
+// New returns a Fileserver. Buckets are addressed with path-style URLs (<endpoint>/<bucket>/<name>),
+// which all S3 compatible services support. If client is nil, http.DefaultClient is used.
+func New(client *http.Client, config Config) *Fileserver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Fileserver{
+		client: client,
+		config: config,
+	}
+}
+
+type Fileserver struct {
+	client *http.Client
+	config Config
+}
+
+// Error is returned when the service responds with an unexpected status.
+type Error struct {
+	StatusCode int
+	Code       string // S3 error code, e.g. NoSuchBucket, if the response has an error document
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 error: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3 error: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsTransient reports whether err is an S3 error that should be retried: rate limiting, server errors
+// and network timeouts. It can be used as constor.Options.Transient.
+func IsTransient(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+	}
+	if e, ok := err.(interface{ Temporary() bool }); ok && e.Temporary() {
+		return true
+	}
+	return false
+}
+
+func (f *Fileserver) Exists(ctx context.Context, bucket, name string) (bool, error) {
+	resp, err := f.do(ctx, "HEAD", bucket, name, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, responseError(resp)
+}
+
+// Write without overwrite is a conditional write (If-None-Match: *), so only one of several concurrent
+// writers succeeds.
+func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	if !overwrite {
+		// avoid sending the contents if the object exists
+		exists, err := f.Exists(ctx, bucket, name)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, nil
+		}
+	}
+	// the payload is signed, so must be read before the request is sent
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return false, err
+	}
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if cacheControl != "" {
+		header.Set("Cache-Control", cacheControl)
+	}
+	if contentEncoding != "" {
+		header.Set("Content-Encoding", contentEncoding)
+	}
+	if !overwrite {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := f.do(ctx, "PUT", bucket, name, nil, header, b)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed && !overwrite {
+		// created by another writer since the exists check
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, responseError(resp)
+	}
+	return true, nil
+}
+
+func (f *Fileserver) Read(ctx context.Context, bucket, name string, writer io.Writer) (found bool, err error) {
+	resp, err := f.do(ctx, "GET", bucket, name, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(resp)
+	}
+	if _, err := io.Copy(writer, resp.Body); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (f *Fileserver) Stat(ctx context.Context, bucket, name string) (attrs services.Attrs, found bool, err error) {
+	resp, err := f.do(ctx, "HEAD", bucket, name, nil, nil, nil)
+	if err != nil {
+		return services.Attrs{}, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return attrsOf(resp), true, nil
+	case http.StatusNotFound:
+		return services.Attrs{}, false, nil
+	}
+	return services.Attrs{}, false, responseError(resp)
+}
+
+func (f *Fileserver) Open(ctx context.Context, bucket, name string, options services.ReadOptions) (reader io.ReadCloser, attrs services.Attrs, found bool, err error) {
+	header := http.Header{}
+	if options.Offset > 0 || options.Length > 0 {
+		r := fmt.Sprintf("bytes=%d-", options.Offset)
+		if options.Length > 0 {
+			r += fmt.Sprint(options.Offset + options.Length - 1)
+		}
+		header.Set("Range", r)
+	}
+	if options.IfNoneMatch != "" {
+		header.Set("If-None-Match", options.IfNoneMatch)
+	}
+	resp, err := f.do(ctx, "GET", bucket, name, nil, header, nil)
+	if err != nil {
+		return nil, services.Attrs{}, false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp.Body, attrsOf(resp), true, nil
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return nil, attrsOf(resp), true, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the offset is past the end
+		resp.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), attrsOf(resp), true, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, services.Attrs{}, false, nil
+	}
+	defer resp.Body.Close()
+	return nil, services.Attrs{}, false, responseError(resp)
+}
+
+// attrsOf reads the object attributes from the response headers. The size of ranged responses is
+// read from Content-Range.
+func attrsOf(resp *http.Response) services.Attrs {
+	attrs := services.Attrs{
+		Size:            resp.ContentLength,
+		ContentType:     resp.Header.Get("Content-Type"),
+		CacheControl:    resp.Header.Get("Cache-Control"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		ETag:            resp.Header.Get("ETag"),
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		if i := strings.LastIndex(cr, "/"); i > -1 {
+			if size, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				attrs.Size = size
+			}
+		}
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		attrs.Updated = t
+	}
+	return attrs
+}
+
+// listResult is the response document of ListObjectsV2
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (f *Fileserver) List(ctx context.Context, bucket, prefix string) ([]services.Object, error) {
+	var objects []services.Object
+	options := services.ListOptions{Prefix: prefix}
+	for {
+		page, next, err := f.ListPage(ctx, bucket, options)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page...)
+		if next == "" {
+			return objects, nil
+		}
+		options.PageToken = next
+	}
+}
+
+// ListPage lists with ListObjectsV2. The page token is the continuation token.
+func (f *Fileserver) ListPage(ctx context.Context, bucket string, options services.ListOptions) (objects []services.Object, next string, err error) {
+	size := options.PageSize
+	if size == 0 {
+		size = services.DefaultPageSize
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {options.Prefix}, "max-keys": {strconv.Itoa(size)}}
+	if options.PageToken != "" {
+		query.Set("continuation-token", options.PageToken)
+	}
+	resp, err := f.do(ctx, "GET", bucket, "", query, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", responseError(resp)
+	}
+	var result listResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	for _, c := range result.Contents {
+		objects = append(objects, services.Object{
+			Name:    c.Key,
+			Size:    c.Size,
+			Updated: c.LastModified,
+		})
+	}
+	if result.IsTruncated {
+		next = result.NextContinuationToken
+	}
+	return objects, next, nil
+}
+
+// Delete deletes the object. S3 doesn't report whether the object existed, so it's checked first.
+func (f *Fileserver) Delete(ctx context.Context, bucket, name string) (found bool, err error) {
+	exists, err := f.Exists(ctx, bucket, name)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, nil
+	}
+	resp, err := f.do(ctx, "DELETE", bucket, name, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return false, responseError(resp)
+	}
+	return true, nil
+}
+
+// do sends a signed request for the object name in bucket, or for the bucket if name is empty.
+func (f *Fileserver) do(ctx context.Context, method, bucket, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	path := "/" + escape(bucket, false)
+	if name != "" {
+		path += "/" + escape(name, true)
+	}
+	u, err := url.Parse(strings.TrimSuffix(f.config.Endpoint, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// objects are returned as stored, so stop the transport requesting and decoding gzip
+	req.Header.Set("Accept-Encoding", "identity")
+	if f.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", f.config.SessionToken)
+	}
+	sum := sha256.Sum256(body)
+	sign(req, f.config.AccessKey, f.config.SecretKey, f.config.Region, hex.EncodeToString(sum[:]), time.Now())
+	return f.client.Do(req)
+}
+
+// responseError reads the error document from resp.
+func responseError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode}
+	var doc struct {
+		Code    string
+		Message string
+	}
+	if b, err := ioutil.ReadAll(resp.Body); err == nil && xml.Unmarshal(b, &doc) == nil {
+		e.Code = doc.Code
+		e.Message = doc.Message
+	}
+	return e
+}
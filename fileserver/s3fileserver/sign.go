@@ -0,0 +1,126 @@
+package s3fileserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm  = "AWS4-HMAC-SHA256"
+	dateFormat = "20060102"
+	timeFormat = "20060102T150405Z"
+)
+
+// sign adds the signature version 4 headers to req. All headers already in req.Header are signed, so
+// they must not be changed before the request is sent.
+func sign(req *http.Request, accessKey, secretKey, region, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(timeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := []string{"host"}
+	for k := range req.Header {
+		signed = append(signed, strings.ToLower(k))
+	}
+	sort.Strings(signed)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm,
+		accessKey,
+		scope(t, region),
+		strings.Join(signed, ";"),
+		signature(req, signed, secretKey, region, payloadHash, t),
+	))
+}
+
+func scope(t time.Time, region string) string {
+	return t.Format(dateFormat) + "/" + region + "/s3/aws4_request"
+}
+
+// signature calculates the signature of req from the signed headers (lower case and sorted).
+func signature(req *http.Request, signed []string, secretKey, region, payloadHash string, t time.Time) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	var headers strings.Builder
+	for _, k := range signed {
+		v := host
+		if k != "host" {
+			v = strings.Join(req.Header[http.CanonicalHeaderKey(k)], ",")
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", k, strings.TrimSpace(v))
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		algorithm,
+		t.Format(timeFormat),
+		scope(t, region),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secretKey), t.Format(dateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, with keys and values escaped as required by the
+// signature.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, escape(k, false)+"="+escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape percent-encodes everything except unreserved characters (and slashes if path is true).
+func escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && path:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
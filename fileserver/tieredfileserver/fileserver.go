@@ -0,0 +1,235 @@
+// package tieredfileserver layers services.Fileservers, e.g. a cachefileserver in front of a
+// localfileserver in front of a gcsfileserver.
+package tieredfileserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dave/services"
+)
+
+// Policy determines how writes reach the tiers.
+type Policy int
+
+const (
+	// WriteThrough writes to every tier before returning, slowest first so the fast tiers never hold
+	// an object that wasn't stored.
+	WriteThrough Policy = iota
+	// WriteBack writes to the fastest tier before returning, and to the other tiers in the background.
+	// Use Wait to wait for the background writes and collect their errors.
+	WriteBack
+)
+
+// New returns a Fileserver with tiers ordered fastest first. The last tier is authoritative: it
+// determines saved for write-through writes, and the results of List.
+func New(policy Policy, tiers ...services.Fileserver) *Fileserver {
+	return &Fileserver{
+		tiers:  tiers,
+		policy: policy,
+	}
+}
+
+type Fileserver struct {
+	tiers  []services.Fileserver
+	policy Policy
+
+	// WriteBackTimeout limits the time of each background write. Zero means no limit.
+	WriteBackTimeout time.Duration
+
+	wg     sync.WaitGroup
+	m      sync.Mutex
+	errors Errors
+}
+
+// Error is a background write or a backfill that failed.
+type Error struct {
+	Bucket, Name string
+	Err          error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s/%s: %v", e.Bucket, e.Name, e.Err)
+}
+
+// Errors is returned by Wait when any background writes or backfills failed.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("failed to write %d item(s): %s", len(e), strings.Join(messages, "; "))
+}
+
+func (f *Fileserver) fail(bucket, name string, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.errors = append(f.errors, &Error{Bucket: bucket, Name: name, Err: err})
+}
+
+// Read tries each tier in order. When an object is found in a slower tier, it's written to the faster
+// tiers with the same attributes so the next read is faster. Errors writing to the faster tiers don't
+// fail the read, but are returned by Wait.
+func (f *Fileserver) Read(ctx context.Context, bucket, name string, writer io.Writer) (found bool, err error) {
+	for i, tier := range f.tiers {
+		reader, attrs, found, err := tier.Open(ctx, bucket, name, services.ReadOptions{})
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			continue
+		}
+		b, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return false, err
+		}
+		for _, faster := range f.tiers[:i] {
+			if _, err := faster.Write(ctx, bucket, name, bytes.NewReader(b), true, attrs.ContentType, attrs.CacheControl, attrs.ContentEncoding); err != nil {
+				f.fail(bucket, name, err)
+			}
+		}
+		if _, err := writer.Write(b); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Exists returns true as soon as a tier has the object.
+func (f *Fileserver) Exists(ctx context.Context, bucket, name string) (bool, error) {
+	for _, tier := range f.tiers {
+		exists, err := tier.Exists(ctx, bucket, name)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return false, err
+	}
+	write := func(ctx context.Context, tier services.Fileserver) (bool, error) {
+		return tier.Write(ctx, bucket, name, bytes.NewReader(b), overwrite, contentType, cacheControl, contentEncoding)
+	}
+	switch f.policy {
+	case WriteBack:
+		saved, err := write(ctx, f.tiers[0])
+		if err != nil {
+			return false, err
+		}
+		for _, tier := range f.tiers[1:] {
+			f.wg.Add(1)
+			go func(tier services.Fileserver) {
+				defer f.wg.Done()
+				// the request context may be cancelled before the background write finishes
+				ctx := context.Background()
+				if f.WriteBackTimeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, f.WriteBackTimeout)
+					defer cancel()
+				}
+				if _, err := write(ctx, tier); err != nil {
+					f.fail(bucket, name, err)
+				}
+			}(tier)
+		}
+		return saved, nil
+	default:
+		for i := len(f.tiers) - 1; i >= 0; i-- {
+			s, err := write(ctx, f.tiers[i])
+			if err != nil {
+				return false, err
+			}
+			if i == len(f.tiers)-1 {
+				if !s && !overwrite {
+					// the object exists, so the faster tiers shouldn't get these contents
+					return false, nil
+				}
+				saved = s
+			}
+		}
+		return saved, nil
+	}
+}
+
+// Stat returns the attributes from the first tier with the object. The ETag isn't comparable between
+// tiers, so a conditional Open should only be used with an ETag from Stat or Open of the same tiers.
+func (f *Fileserver) Stat(ctx context.Context, bucket, name string) (attrs services.Attrs, found bool, err error) {
+	for _, tier := range f.tiers {
+		attrs, found, err := tier.Stat(ctx, bucket, name)
+		if err != nil {
+			return services.Attrs{}, false, err
+		}
+		if found {
+			return attrs, true, nil
+		}
+	}
+	return services.Attrs{}, false, nil
+}
+
+// Open streams from the first tier with the object. Unlike Read, the faster tiers aren't updated.
+func (f *Fileserver) Open(ctx context.Context, bucket, name string, options services.ReadOptions) (reader io.ReadCloser, attrs services.Attrs, found bool, err error) {
+	for _, tier := range f.tiers {
+		reader, attrs, found, err := tier.Open(ctx, bucket, name, options)
+		if err != nil {
+			return nil, services.Attrs{}, false, err
+		}
+		if found {
+			return reader, attrs, true, nil
+		}
+	}
+	return nil, services.Attrs{}, false, nil
+}
+
+// List lists the authoritative tier.
+func (f *Fileserver) List(ctx context.Context, bucket, prefix string) ([]services.Object, error) {
+	return f.tiers[len(f.tiers)-1].List(ctx, bucket, prefix)
+}
+
+// ListPage lists the authoritative tier.
+func (f *Fileserver) ListPage(ctx context.Context, bucket string, options services.ListOptions) (objects []services.Object, next string, err error) {
+	return f.tiers[len(f.tiers)-1].ListPage(ctx, bucket, options)
+}
+
+// Delete deletes from every tier, slowest first so a concurrent read can't copy the object back to a
+// faster tier. found is true if any tier had the object.
+func (f *Fileserver) Delete(ctx context.Context, bucket, name string) (found bool, err error) {
+	for i := len(f.tiers) - 1; i >= 0; i-- {
+		ok, err := f.tiers[i].Delete(ctx, bucket, name)
+		if err != nil {
+			return false, err
+		}
+		found = found || ok
+	}
+	return found, nil
+}
+
+// Wait waits for background writes to finish. If any background writes or backfills failed since the
+// last call, the error is Errors.
+func (f *Fileserver) Wait() error {
+	f.wg.Wait()
+	f.m.Lock()
+	defer f.m.Unlock()
+	errs := f.errors
+	f.errors = nil
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package tieredfileserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/dave/services"
+	"github.com/dave/services/fileserver/cachefileserver"
+	"github.com/dave/services/fileserver/fileservertest"
+)
+
+func TestReadBackfill(t *testing.T) {
+	ctx := context.Background()
+	fast, slow := cachefileserver.New(1000, 1000), cachefileserver.New(1000, 1000)
+	f := New(WriteThrough, fast, slow)
+	if _, err := slow.Write(ctx, "bucket", "a", strings.NewReader("a"), true, "text/plain", "no-cache", "gzip"); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	found, err := f.Read(ctx, "bucket", "a", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || buf.String() != "a" {
+		t.Fatalf("expected a, got %v %q", found, buf.String())
+	}
+	attrs, exists, err := fast.Stat(ctx, "bucket", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("expected a to be copied to the fast tier")
+	}
+	if attrs.ContentType != "text/plain" || attrs.CacheControl != "no-cache" || attrs.ContentEncoding != "gzip" {
+		t.Fatalf("expected attributes to be copied, got %+v", attrs)
+	}
+}
+
+// failing is a services.Fileserver that fails every write.
+type failing struct {
+	services.Fileserver
+}
+
+func (failing) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	return false, errors.New("failed")
+}
+
+func TestBackfillErrors(t *testing.T) {
+	ctx := context.Background()
+	slow := cachefileserver.New(1000, 1000)
+	f := New(WriteThrough, failing{cachefileserver.New(1000, 1000)}, failing{cachefileserver.New(1000, 1000)}, slow)
+	for _, name := range []string{"a", "b"} {
+		if _, err := slow.Write(ctx, "bucket", name, strings.NewReader(name), true, "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if found, err := f.Read(ctx, "bucket", name, &bytes.Buffer{}); err != nil || !found {
+			t.Fatalf("expected %s to be read, got %v %v", name, found, err)
+		}
+	}
+	errs, ok := f.Wait().(Errors)
+	if !ok || len(errs) != 4 || errs[0].Name != "a" || errs[3].Name != "b" {
+		t.Fatalf("expected every backfill error, got %v", errs)
+	}
+	if err := f.Wait(); err != nil {
+		t.Fatalf("expected errors to be cleared, got %v", err)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	ctx := context.Background()
+	fast, slow := cachefileserver.New(1000, 1000), cachefileserver.New(1000, 1000)
+	f := New(WriteBack, fast, slow)
+	saved, err := f.Write(ctx, "bucket", "a", strings.NewReader("a"), false, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved {
+		t.Fatal("expected saved")
+	}
+	if err := f.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := slow.Exists(ctx, "bucket", "a"); !exists {
+		t.Fatal("expected a to be written to the slow tier")
+	}
+	if found, _ := f.Delete(ctx, "bucket", "a"); !found {
+		t.Fatal("expected a to be deleted")
+	}
+	if exists, _ := f.Exists(ctx, "bucket", "a"); exists {
+		t.Fatal("expected a to be deleted from every tier")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	fileservertest.Run(t, func(t *testing.T) (services.Fileserver, func()) {
+		return New(WriteThrough, cachefileserver.New(1<<24, 1<<24), cachefileserver.New(1<<24, 1<<24)), nil
+	})
+}
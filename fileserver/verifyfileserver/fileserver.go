@@ -0,0 +1,117 @@
+// package verifyfileserver wraps a services.Fileserver, checking that the contents of objects match the
+// SHA-1 hash embedded in their names.
+package verifyfileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/dave/services"
+)
+
+// DefaultPatterns match the names of objects that are named by the SHA-1 hash of their contents:
+// <path>.<hash>.js (package, loader and prelude JS), <hash> and <hash>/index.html (hash indexes) and
+// manifest/<path>.<hash>.json (deploy manifests). Stripped archives (<path>.<hash>.ax) are named by the
+// hash of the package JS, so are not verified.
+var DefaultPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^.+\.([0-9a-f]{40})\.js$`),
+	regexp.MustCompile(`^([0-9a-f]{40})(/index\.html)?$`),
+	regexp.MustCompile(`^manifest/.+\.([0-9a-f]{40})\.json$`),
+}
+
+func New(fileserver services.Fileserver) *Fileserver {
+	return &Fileserver{
+		Fileserver: fileserver,
+		Patterns:   DefaultPatterns,
+	}
+}
+
+type Fileserver struct {
+	services.Fileserver
+
+	// Patterns match the names of objects to verify. The first submatch is the hex encoded SHA-1 hash
+	// of the contents. Objects that don't match are not verified.
+	Patterns []*regexp.Regexp
+}
+
+// IntegrityError is returned when the contents of an object don't match the hash in its name.
+type IntegrityError struct {
+	Bucket, Name     string
+	Expected, Actual string // hex encoded SHA-1 hashes
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity error in %s/%s: expected hash %s, got %s", e.Bucket, e.Name, e.Expected, e.Actual)
+}
+
+// expected returns the hash in the name, or false if the object shouldn't be verified.
+func (f *Fileserver) expected(name string) (string, bool) {
+	for _, p := range f.Patterns {
+		if matches := p.FindStringSubmatch(name); matches != nil {
+			return matches[1], true
+		}
+	}
+	return "", false
+}
+
+// Write verifies the contents before writing. Encoded contents are not verified.
+func (f *Fileserver) Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error) {
+	expected, ok := f.expected(name)
+	if !ok || contentEncoding != "" {
+		return f.Fileserver.Write(ctx, bucket, name, reader, overwrite, contentType, cacheControl, contentEncoding)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, reader); err != nil {
+		return false, err
+	}
+	if actual := fmt.Sprintf("%x", sha1.Sum(buf.Bytes())); actual != expected {
+		return false, &IntegrityError{Bucket: bucket, Name: name, Expected: expected, Actual: actual}
+	}
+	return f.Fileserver.Write(ctx, bucket, name, buf, overwrite, contentType, cacheControl, contentEncoding)
+}
+
+// Read verifies the contents before copying them to writer, so nothing is written if verification
+// fails. Encoded contents are not verified.
+func (f *Fileserver) Read(ctx context.Context, bucket, name string, writer io.Writer) (found bool, err error) {
+	if _, ok := f.expected(name); !ok {
+		return f.Fileserver.Read(ctx, bucket, name, writer)
+	}
+	reader, _, found, err := f.Open(ctx, bucket, name, services.ReadOptions{})
+	if err != nil || !found {
+		return found, err
+	}
+	defer reader.Close()
+	if _, err := io.Copy(writer, reader); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Open verifies the contents of full reads before returning the reader. Ranged reads can't be
+// verified.
+func (f *Fileserver) Open(ctx context.Context, bucket, name string, options services.ReadOptions) (reader io.ReadCloser, attrs services.Attrs, found bool, err error) {
+	expected, ok := f.expected(name)
+	if !ok || options.Offset > 0 || options.Length > 0 {
+		return f.Fileserver.Open(ctx, bucket, name, options)
+	}
+	reader, attrs, found, err = f.Fileserver.Open(ctx, bucket, name, options)
+	if err != nil || !found || reader == nil {
+		return reader, attrs, found, err
+	}
+	defer reader.Close()
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, services.Attrs{}, false, err
+	}
+	if attrs.ContentEncoding == "" {
+		if actual := fmt.Sprintf("%x", sha1.Sum(b)); actual != expected {
+			return nil, services.Attrs{}, false, &IntegrityError{Bucket: bucket, Name: name, Expected: expected, Actual: actual}
+		}
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), attrs, true, nil
+}
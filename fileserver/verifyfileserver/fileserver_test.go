@@ -0,0 +1,82 @@
+package verifyfileserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dave/services"
+	"github.com/dave/services/fileserver/cachefileserver"
+	"github.com/dave/services/fileserver/fileservertest"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	cache := cachefileserver.New(1000, 1000)
+	f := New(cache)
+
+	contents := "foo"
+	name := fmt.Sprintf("a/b.%x.js", sha1.Sum([]byte(contents)))
+
+	if _, err := f.Write(ctx, "pkg", name, strings.NewReader(contents), false, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(ctx, "pkg", name, strings.NewReader("bar"), true, "", "", ""); err == nil {
+		t.Fatal("expected integrity error on write")
+	} else if _, ok := err.(*IntegrityError); !ok {
+		t.Fatalf("expected *IntegrityError, got %#v", err)
+	}
+
+	// unverified names are written as normal
+	if _, err := f.Write(ctx, "pkg", "a/b.json", strings.NewReader("bar"), true, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if found, err := f.Read(ctx, "pkg", name, buf); err != nil || !found || buf.String() != contents {
+		t.Fatalf("unexpected read: %v, %v, %q", found, err, buf.String())
+	}
+
+	// corrupt the underlying object
+	if _, err := cache.Write(ctx, "pkg", name, strings.NewReader("bar"), true, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := f.Read(ctx, "pkg", name, buf); err == nil {
+		t.Fatal("expected integrity error on read")
+	} else if _, ok := err.(*IntegrityError); !ok {
+		t.Fatalf("expected *IntegrityError, got %#v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatal("expected nothing to be written on integrity error")
+	}
+}
+
+func TestVerifyEncoded(t *testing.T) {
+	ctx := context.Background()
+	f := New(cachefileserver.New(1000, 1000))
+
+	gz := &bytes.Buffer{}
+	w := gzip.NewWriter(gz)
+	w.Write([]byte("foo"))
+	w.Close()
+	name := fmt.Sprintf("a/b.%x.js", sha1.Sum([]byte("foo")))
+
+	if _, err := f.Write(ctx, "pkg", name, bytes.NewReader(gz.Bytes()), false, "", "", "gzip"); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if found, err := f.Read(ctx, "pkg", name, buf); err != nil || !found || buf.String() != gz.String() {
+		t.Fatalf("unexpected read: %v, %v, %q", found, err, buf.String())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	fileservertest.Run(t, func(t *testing.T) (services.Fileserver, func()) {
+		return New(cachefileserver.New(1<<24, 1<<24)), nil
+	})
+}
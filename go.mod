@@ -4,6 +4,7 @@ go 1.12
 
 require (
 	cloud.google.com/go/datastore v1.0.0
+	github.com/andybalholm/brotli v0.0.0-20190621154722-5f990b63d2d6
 	github.com/gopherjs/gopherjs v0.0.0-20191106031601-ce3c9ade29de
 	github.com/kisielk/gotool v1.0.0 // indirect
 	github.com/neelance/astrewrite v0.0.0-20160511093645-99348263ae86 // indirect
@@ -11,5 +12,7 @@ require (
 	github.com/shurcooL/httpfs v0.0.0-20190707220628-8d4bc4ba7749 // indirect
 	github.com/spf13/cobra v0.0.5 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	go.etcd.io/bbolt v1.3.4
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5 // indirect
 	gopkg.in/src-d/go-billy.v4 v4.3.2
 )
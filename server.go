@@ -5,17 +5,83 @@ package services
 import (
 	"context"
 	"io"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	billy "gopkg.in/src-d/go-billy.v4"
 )
 
 // Fileserver provides the functionality to persist files and host them for web delivery. In production
-// we use GCS buckets. In local storage mode we use a temporary directory
+// we use GCS buckets. In local storage mode we use a temporary directory. If contentEncoding is set,
+// the contents written are already encoded (e.g. "gzip").
 type Fileserver interface {
-	Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl string) (saved bool, err error)
+	Write(ctx context.Context, bucket, name string, reader io.Reader, overwrite bool, contentType, cacheControl, contentEncoding string) (saved bool, err error)
 	Read(ctx context.Context, bucket, name string, writer io.Writer) (found bool, err error)
 	Exists(ctx context.Context, bucket, name string) (bool, error)
+	List(ctx context.Context, bucket, prefix string) ([]Object, error)
+	ListPage(ctx context.Context, bucket string, options ListOptions) (objects []Object, next string, err error)
+	Delete(ctx context.Context, bucket, name string) (found bool, err error)
+
+	// Stat returns the attributes of a file without reading the contents.
+	Stat(ctx context.Context, bucket, name string) (attrs Attrs, found bool, err error)
+
+	// Open streams the contents of a file, or the range in options. If options.IfNoneMatch is the
+	// ETag of the file, reader is nil. Otherwise reader must be closed.
+	Open(ctx context.Context, bucket, name string, options ReadOptions) (reader io.ReadCloser, attrs Attrs, found bool, err error)
+}
+
+// Object describes a stored file, as returned by Fileserver.List
+type Object struct {
+	Name    string
+	Size    int64
+	Updated time.Time
+}
+
+// ListOptions configures Fileserver.ListPage. Objects are listed in order of name.
+type ListOptions struct {
+	Prefix    string
+	PageToken string // The next token returned with the previous page, or empty for the first page
+	PageSize  int    // The maximum number of objects in the page. Zero means DefaultPageSize.
+}
+
+// DefaultPageSize is the page size used by Fileserver.ListPage if ListOptions.PageSize is zero.
+const DefaultPageSize = 1000
+
+// Page returns the page selected by options of all, the objects with the prefix in order of name. It's
+// used by fileservers that can only list everything, so listing each page is O(n) in the number of
+// objects. The page token is the name of the last object in the previous page.
+func Page(all []Object, options ListOptions) (objects []Object, next string) {
+	size := options.PageSize
+	if size == 0 {
+		size = DefaultPageSize
+	}
+	for _, o := range all {
+		if o.Name <= options.PageToken {
+			continue
+		}
+		if len(objects) == size {
+			return objects, objects[len(objects)-1].Name
+		}
+		objects = append(objects, o)
+	}
+	return objects, ""
+}
+
+// Attrs describes a stored file, as returned by Fileserver.Stat and Fileserver.Open
+type Attrs struct {
+	Size            int64
+	ContentType     string
+	CacheControl    string
+	ContentEncoding string
+	ETag            string // Opaque, and changes when the contents change (e.g. the GCS generation)
+	Updated         time.Time
+}
+
+// ReadOptions configures Fileserver.Open
+type ReadOptions struct {
+	Offset      int64  // Start of the range
+	Length      int64  // Length of the range. Zero reads to the end.
+	IfNoneMatch string // Don't read the contents if this is the ETag of the file
 }
 
 // Database provides the functionality to persist and recall data. In production we use the gcs datastore.
@@ -25,6 +91,28 @@ type Database interface {
 	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
 	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) (err error)
 	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) (_ []*datastore.Key, err error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) (err error)
+
+	// Query loads the entities matching q into dst, which must be a pointer to a slice of structs or
+	// struct pointers, and returns their keys.
+	Query(ctx context.Context, q Query, dst interface{}) ([]*datastore.Key, error)
+
+	// RunInTransaction runs f in a transaction. The operations on tx are committed atomically if f
+	// returns nil. f may be run more than once if the transaction conflicts with another, so it
+	// shouldn't have other side effects.
+	RunInTransaction(ctx context.Context, f func(tx Database) error) error
+}
+
+// Query selects entities of a kind. Entities are returned in order of key.
+type Query struct {
+	Kind     string
+	Ancestor *datastore.Key // Only entities that are Ancestor or descendants of Ancestor
+	Limit    int            // The maximum number of entities. Zero means no limit.
+
+	// Prefix selects entities with names starting with Prefix. Prefix queries are key range queries,
+	// so only match entities with the parent Ancestor (root entities if Ancestor is nil).
+	Prefix string
 }
 
 // Resolver provides the functionality to resolve package paths to repo URLs. In production mode this
@@ -0,0 +1,28 @@
+package signedurl
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	key := []byte("key")
+	now := time.Unix(1000, 0)
+	query, err := url.ParseQuery(Query(key, "a.js", now.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(key, "a.js", query, now); err != nil {
+		t.Fatalf("expected valid, got %v", err)
+	}
+	if err := Verify(key, "b.js", query, now); err != ErrInvalid {
+		t.Fatalf("expected ErrInvalid for other name, got %v", err)
+	}
+	if err := Verify([]byte("other"), "a.js", query, now); err != ErrInvalid {
+		t.Fatalf("expected ErrInvalid for other key, got %v", err)
+	}
+	if err := Verify(key, "a.js", query, now.Add(2*time.Hour)); err != ErrExpired {
+		t.Fatalf("expected ErrExpired, got %v", err)
+	}
+}
@@ -25,15 +25,16 @@ func Handler(w http.ResponseWriter, req *http.Request) {
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
-	Default = &Tracker{jobs: make(map[*Job]bool), id: rand.Intn(1000)}
+	Default = &Tracker{jobs: make(map[*Job]bool), stats: make(map[string]func() interface{}), id: rand.Intn(1000)}
 }
 
 var Default *Tracker
 
 type Tracker struct {
 	sync.Mutex
-	id   int // random number so we can tell the servers apart
-	jobs map[*Job]bool
+	id    int // random number so we can tell the servers apart
+	jobs  map[*Job]bool
+	stats map[string]func() interface{}
 }
 
 type Job struct {
@@ -54,9 +55,22 @@ type jobInfo struct {
 	Logs                                           string
 }
 
+type statsInfo struct {
+	Name, Stats string
+}
+
 type pageInfo struct {
-	Id   string
-	Jobs []jobInfo
+	Id    string
+	Jobs  []jobInfo
+	Stats []statsInfo
+}
+
+// AddStats adds a named set of counters (e.g. cachefileserver.Fileserver.Stats) to the page. The
+// function is called each time the page is rendered.
+func (t *Tracker) AddStats(name string, stats func() interface{}) {
+	t.Lock()
+	defer t.Unlock()
+	t.stats[name] = stats
 }
 
 func (t *Tracker) Start() *Job {
@@ -97,9 +111,16 @@ func (t *Tracker) info() pageInfo {
 		ji.QueuePos = fmt.Sprint(j.queuePos)
 		info = append(info, ji)
 	}
+	var stats []statsInfo
+	for name, f := range t.stats {
+		b, _ := json.MarshalIndent(f(), "", "\t")
+		stats = append(stats, statsInfo{Name: name, Stats: string(b)})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
 	return pageInfo{
-		Id:   fmt.Sprint(t.id),
-		Jobs: info,
+		Id:    fmt.Sprint(t.id),
+		Jobs:  info,
+		Stats: stats,
 	}
 }
 
@@ -187,6 +208,12 @@ var infoTmpl = template.Must(template.New("main").Parse(`<html>
 				</tr>
 			{{ end }}
 		</table>
+		{{ range .Stats }}
+			<h2>
+				{{ .Name }}
+			</h2>
+			<pre>{{ .Stats }}</pre>
+		{{ end }}
 	</body>
 </html>
 `))